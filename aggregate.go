@@ -0,0 +1,182 @@
+package monitor_tool
+
+import (
+	"strconv"
+)
+
+// AggregatedReport Calls of an entry with the same code that were already counted by the source, such as
+// an edge proxy or a log shipper, see ReportBatch
+type AggregatedReport struct {
+	Name   string
+	Labels map[string]string
+	Code   int
+	// Number of calls, a report without calls is ignored
+	Count uint32
+	// Total, minimum and maximum elapsed time of the calls in milliseconds, only used and checked when the
+	// code is a success. SumMs must lie between Count*MinMs and Count*MaxMs
+	SumMs uint64
+	MinMs uint32
+	MaxMs uint32
+	// Number of calls by elapsed time in milliseconds, typically the upper bound of each bucket of the
+	// source, the counts add up to Count. Times outside [MinMs, MaxMs] are clamped into it, ignored like the
+	// elapsed times when the code is a failure.
+	// Without a histogram every call is counted at the average elapsed time, in the distribution,
+	// the percentiles and FastCount
+	Histogram map[uint32]uint32
+}
+
+// AggregateError An AggregatedReport that is not consistent, the batch was not reported
+type AggregateError struct {
+	// Position of the report in the batch
+	Index  int
+	Name   string
+	Reason string
+}
+
+func (e *AggregateError) Error() string {
+	return "invalid aggregated report " + strconv.Itoa(e.Index) + " (" + e.Name + "): " + e.Reason
+}
+
+// ReportBatch Merge pre-aggregated calls into the statistics, the same way as the calls reported one at a
+// time: they share the entries, the outputs and the alarms. The whole batch is a single task of the task
+// channel, checked beforehand (an inconsistent report fails it with an *AggregateError) and dropped as a
+// whole by the overflow policy, its calls are counted in Dropped then.
+// The names go through NameNormalizer and MaxNames, the reports and their maps are copied
+func (c *ReportClientConfig) ReportBatch(reports []AggregatedReport) error {
+	batch := make([]AggregatedReport, 0, len(reports))
+	for i, r := range reports {
+		if r.Count == 0 {
+			continue
+		}
+		if reason := r.check(c.codeSuccess(r.Code)); reason != "" {
+			return &AggregateError{Index: i, Name: r.Name, Reason: reason}
+		}
+		r.Name = c.reportName(r.Name)
+		if len(r.Labels) > 0 {
+			labels := make(map[string]string, len(r.Labels))
+			for k, v := range r.Labels {
+				labels[k] = v
+			}
+			r.Labels = labels
+		} else {
+			r.Labels = nil
+		}
+		if r.Histogram != nil {
+			histogram := make(map[uint32]uint32, len(r.Histogram))
+			for ms, n := range r.Histogram {
+				if n > 0 {
+					histogram[ms] = n
+				}
+			}
+			r.Histogram = histogram
+		}
+		batch = append(batch, r)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return c.send(&taskQueue{
+		taskType: BATCH,
+		data:     batch,
+	}, c.OverflowPolicy)
+}
+
+// ReportAggregated Same as ReportBatch for the calls of a single name and code, without labels
+func (c *ReportClientConfig) ReportAggregated(name string, code int, count uint32, sumMs uint64, minMs uint32, maxMs uint32, histogram map[uint32]uint32) error {
+	return c.ReportBatch([]AggregatedReport{{
+		Name:      name,
+		Code:      code,
+		Count:     count,
+		SumMs:     sumMs,
+		MinMs:     minMs,
+		MaxMs:     maxMs,
+		Histogram: histogram,
+	}})
+}
+
+// Why the report is inconsistent, empty if it is not. The elapsed times of failures are not counted
+func (r *AggregatedReport) check(success bool) string {
+	if !success {
+		return ""
+	}
+	if r.MinMs > r.MaxMs {
+		return "MinMs is greater than MaxMs"
+	}
+	if r.SumMs < uint64(r.Count)*uint64(r.MinMs) || r.SumMs > uint64(r.Count)*uint64(r.MaxMs) {
+		return "SumMs is not between Count*MinMs and Count*MaxMs"
+	}
+	if r.Histogram != nil {
+		var total uint64
+		for _, n := range r.Histogram {
+			total += uint64(n)
+		}
+		if total != uint64(r.Count) {
+			return "the histogram counts " + strconv.FormatUint(total, 10) + " calls instead of Count"
+		}
+	}
+	return ""
+}
+
+// Number of calls the task carries, what is counted as dropped when it is
+func (t *taskQueue) calls() uint64 {
+	if t.taskType != BATCH {
+		return 1
+	}
+	var calls uint64
+	for _, r := range t.data.([]AggregatedReport) {
+		calls += uint64(r.Count)
+	}
+	return calls
+}
+
+func (c *ReportClientConfig) batchTask(batch []AggregatedReport) {
+	for i := range batch {
+		r := &batch[i]
+		success := c.codeSuccess(r.Code)
+		seriesData, groupData := c.targetData(c.collectDataMap, r.Name, r.Labels)
+		seriesData.recordAggregated(r, success)
+		if groupData != nil {
+			groupData.recordAggregated(r, success)
+		}
+	}
+}
+
+// Same counting as record, for r.Count calls
+func (d *reportData) recordAggregated(r *AggregatedReport, success bool) {
+	if d.TimeConsumingDistribution == nil {
+		d.TimeConsumingDistribution = make([]uint32, len(d.Config.bucketLabels))
+	}
+	if !success {
+		d.FailCount += r.Count
+		d.FailDistribution[r.Code] += r.Count
+		return
+	}
+	d.SuccessCount += r.Count
+	minUs, maxUs := uint64(r.MinMs)*usPerMs, uint64(r.MaxMs)*usPerMs
+	d.setMinMax(minUs, maxUs)
+	d.SuccessUsCount += r.SumMs * usPerMs
+	if r.Histogram == nil {
+		d.recordElapsed(r.SumMs*usPerMs/uint64(r.Count), r.Count)
+		return
+	}
+	for ms, n := range r.Histogram {
+		us := uint64(ms) * usPerMs
+		if us < minUs {
+			us = minUs
+		} else if us > maxUs {
+			us = maxUs
+		}
+		d.recordElapsed(us, n)
+	}
+}
+
+// Count n successes of the same elapsed time into the distribution, the sketch and FastCount
+func (d *reportData) recordElapsed(us uint64, n uint32) {
+	d.TimeConsumingDistribution[d.Config.bucketIndex(us)] += n
+	if d.sketch != nil {
+		d.sketch.add(us, uint64(n))
+	}
+	if us <= d.Config.fastLessThanUs {
+		d.FastCount += n
+	}
+}
@@ -0,0 +1,32 @@
+package monitor_tool
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestAggregatedFailuresSkipLatencyChecks(t *testing.T) {
+	client, outputs := collectingClient(t, ReportClientConfig{Name: "aggregated", StatisticalCycle: 60000})
+	// Only the count of a failure is used, whatever its elapsed times
+	if err := client.ReportAggregated("entry", 500, 3, 0, 20, 10, map[uint32]uint32{1: 1}); err != nil {
+		t.Fatalf("the failures were rejected: %v", err)
+	}
+	var aggregateErr *AggregateError
+	if err := client.ReportAggregated("entry", 200, 3, 0, 20, 10, nil); !errors.As(err, &aggregateErr) {
+		t.Fatalf("the inconsistent successes returned %v, want an *AggregateError", err)
+	}
+	if err := client.ReportAggregated("entry", 200, 2, 30, 10, 20, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := outputs()
+	if len(got) != 1 {
+		t.Fatalf("%d outputs, want 1", len(got))
+	}
+	if o := got[0]; o.FailCount != 3 || o.SuccessCount != 2 || o.MinMs != 10 || o.MaxMs != 20 {
+		t.Fatalf("FailCount %d, SuccessCount %d, MinMs %d, MaxMs %d, want 3, 2, 10 and 20", o.FailCount, o.SuccessCount, o.MinMs, o.MaxMs)
+	}
+}
@@ -49,3 +49,18 @@ func defaultRecover(clientName string, interfaceName string, alertType AlertType
 	}
 	os.Stderr.WriteString(alertString.String() + "\n")
 }
+
+// Default notice of the custom rules, for alarms and recoveries alike
+func defaultRuleNotice(c *ReportClientConfig, kind AlertEventKind, clientName string, interfaceName string, rule *AlertRule, recentOutputData []OutPutData) {
+	title := "Alerts"
+	if kind == RECOVERED {
+		title = "Recovery Notice"
+	}
+	var alertString bytes.Buffer
+	alertString.WriteString("\n " + title + "：\n   Client reporting type：" + clientName + "\n   Interface：" + interfaceName + "\n   Rule：" + rule.Name + " (" + rule.Metric + " " + rule.Op + " " + strconv.FormatFloat(rule.Threshold, 'f', -1, 64) + ")\n   Recent" + strconv.Itoa(len(recentOutputData)) + "Status：")
+	for i := range recentOutputData {
+		_, value := rule.evaluate(c, &recentOutputData[i])
+		alertString.WriteString("\n     " + strconv.Itoa(i+1) + ". " + "Call" + strconv.FormatUint(uint64(recentOutputData[i].Count), 10) + "times，" + rule.Metric + "for" + strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	os.Stderr.WriteString(alertString.String() + "\n")
+}
@@ -0,0 +1,194 @@
+package monitor_tool
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// AlertRule A declarative alarm condition evaluated on every OutPutData of an entry (or alert group).
+// The alarm is raised once the condition has held for For consecutive periods, and recovers once it has
+// not held for Recover consecutive periods. The FAIL and SLOW alarms are built-in rules of the same kind,
+// built from SuccessRate, FastRate and the AlertFor* counts of the entry configuration
+type AlertRule struct {
+	// Identifies the rule in events, metrics and default notices, unique within the client.
+	// FAIL and SLOW are the names of the built-in rules
+	Name string
+	// The compared value, the name of a field of OutPutData: count, successCount, failCount, fastCount,
+	// droppedCount, successRate, fastRate, successMsAver, maxMs, minMs, or a percentile such as p99.
+	// Derived values: failRate, and failCount:<code> or failRate:<code> for a single failure code.
+	// Latency values (fastRate, successMsAver, maxMs, minMs and percentiles) only exist when the period has
+	// successes, a period where the value does not exist counts as healthy. They are in milliseconds with
+	// the fraction of the microseconds, so that a threshold of 0.5 catches sub-millisecond regressions
+	Metric string
+	// Comparison of the value against the threshold that is an alarm condition: <, <=, > or >=
+	Op        string
+	Threshold float64
+	// Consecutive periods meeting the condition that raise the alarm, the default is 3
+	For int
+	// Consecutive periods not meeting the condition that recover from the alarm, the default is 3
+	Recover int
+	// Severity of the events, the default is AlertSeverity[Type] or else warning
+	Severity string
+	// Labels added to the events of the rule, e.g. a team to route them to
+	Labels map[string]string
+	// Passed to AlertCaller and RecoverCaller, the default is RULE. Custom values, e.g.
+	// const P99_SLOW AlertType = 10, tell the rules apart in the callers, AlertEventCaller has the Name
+	Type AlertType
+	// Resolved by normalize
+	value    func(c *ReportClientConfig, o *OutPutData) (float64, bool)
+	breached func(value float64, threshold float64) bool
+	builtin  bool
+}
+
+var alertRuleOps = map[string]func(value float64, threshold float64) bool{
+	"<":  func(value float64, threshold float64) bool { return value < threshold },
+	"<=": func(value float64, threshold float64) bool { return value <= threshold },
+	">":  func(value float64, threshold float64) bool { return value > threshold },
+	">=": func(value float64, threshold float64) bool { return value >= threshold },
+}
+
+// The built-in rules first, in the order they were always analyzed, then the custom ones
+func (c *ReportClientConfig) normalizeAlertRules(k *configChecker) {
+	c.alertRules = nil
+	if !c.DisableDefaultAlertRules {
+		c.alertRules = append(c.alertRules, AlertRule{
+			Name:      SLOW.String(),
+			Metric:    "fastRate",
+			Op:        "<",
+			Threshold: c.FastRate,
+			For:       c.AlertForBadFastRateReachedTimes,
+			Recover:   c.AlertForGreatFastRateReachedTimes,
+			Type:      SLOW,
+			builtin:   true,
+		}, AlertRule{
+			Name:      FAIL.String(),
+			Metric:    "successRate",
+			Op:        "<",
+			Threshold: c.SuccessRate,
+			For:       c.AlertForBadSuccessRateReachedTimes,
+			Recover:   c.AlertForGreatSuccessRateReachedTimes,
+			Type:      FAIL,
+			builtin:   true,
+		})
+	}
+	c.alertRules = append(c.alertRules, c.AlertRules...)
+	names := map[string]bool{}
+	for i := range c.alertRules {
+		rule := &c.alertRules[i]
+		field := "AlertRules[" + strconv.Itoa(i-(len(c.alertRules)-len(c.AlertRules))) + "]."
+		if rule.Name == "" {
+			k.problem(field+"Name", rule.Name, "must not be empty")
+		} else if names[rule.Name] {
+			k.problem(field+"Name", rule.Name, "is already the name of another rule")
+		}
+		names[rule.Name] = true
+		var ok bool
+		if rule.value, ok = alertMetric(rule.Metric); !ok {
+			k.problem(field+"Metric", rule.Metric, "unknown metric")
+		}
+		if rule.breached, ok = alertRuleOps[rule.Op]; !ok {
+			k.problem(field+"Op", rule.Op, "must be one of <, <=, > and >=")
+		}
+		if math.IsNaN(rule.Threshold) {
+			k.problem(field+"Threshold", rule.Threshold, "must be a number")
+		}
+		if rule.builtin {
+			continue
+		}
+		k.checkInt(field+"For", &rule.For, 3, 1, math.MaxInt)
+		k.checkInt(field+"Recover", &rule.Recover, 3, 1, math.MaxInt)
+		if rule.Type == NONE {
+			rule.Type = RULE
+		}
+	}
+	for i := range c.alertRules {
+		rule := &c.alertRules[i]
+		if rule.Severity == "" {
+			if rule.Severity = c.AlertSeverity[rule.Type]; rule.Severity == "" {
+				rule.Severity = "warning"
+			}
+		}
+	}
+}
+
+// Value of a metric in an output, false when the output has no such value
+func alertMetric(metric string) (func(c *ReportClientConfig, o *OutPutData) (float64, bool), bool) {
+	if name, code, ok := strings.Cut(metric, ":"); ok {
+		status, err := strconv.Atoi(code)
+		if err != nil {
+			return nil, false
+		}
+		switch name {
+		case "failCount":
+			return func(c *ReportClientConfig, o *OutPutData) (float64, bool) {
+				return float64(o.FailDistribution[c.failName(status)]), true
+			}, true
+		case "failRate":
+			return func(c *ReportClientConfig, o *OutPutData) (float64, bool) {
+				return float64(o.FailDistribution[c.failName(status)]) / float64(o.Count), o.Count > 0
+			}, true
+		}
+		return nil, false
+	}
+	switch metric {
+	case "count":
+		return func(c *ReportClientConfig, o *OutPutData) (float64, bool) { return float64(o.Count), true }, true
+	case "successCount":
+		return func(c *ReportClientConfig, o *OutPutData) (float64, bool) { return float64(o.SuccessCount), true }, true
+	case "failCount":
+		return func(c *ReportClientConfig, o *OutPutData) (float64, bool) { return float64(o.FailCount), true }, true
+	case "fastCount":
+		return func(c *ReportClientConfig, o *OutPutData) (float64, bool) { return float64(o.FastCount), true }, true
+	case "droppedCount":
+		return func(c *ReportClientConfig, o *OutPutData) (float64, bool) { return float64(o.DroppedCount), true }, true
+	case "successRate":
+		return func(c *ReportClientConfig, o *OutPutData) (float64, bool) { return o.SuccessRate, o.Count > 0 }, true
+	case "failRate":
+		return func(c *ReportClientConfig, o *OutPutData) (float64, bool) {
+			return float64(o.FailCount) / float64(o.Count), o.Count > 0
+		}, true
+	case "fastRate":
+		return func(c *ReportClientConfig, o *OutPutData) (float64, bool) { return o.FastRate, o.SuccessCount > 0 }, true
+	case "successMsAver":
+		return func(c *ReportClientConfig, o *OutPutData) (float64, bool) {
+			return float64(o.SuccessUsAver) / usPerMs, o.SuccessCount > 0
+		}, true
+	case "maxMs":
+		return func(c *ReportClientConfig, o *OutPutData) (float64, bool) {
+			return float64(o.MaxUs) / usPerMs, o.SuccessCount > 0
+		}, true
+	case "minMs":
+		return func(c *ReportClientConfig, o *OutPutData) (float64, bool) {
+			return float64(o.MinUs) / usPerMs, o.SuccessCount > 0
+		}, true
+	}
+	// Percentiles are named p followed by digits, an entry that does not estimate it never alarms
+	if len(metric) > 1 && metric[0] == 'p' && strings.Trim(metric[1:], "0123456789") == "" {
+		return func(c *ReportClientConfig, o *OutPutData) (float64, bool) {
+			value, ok := o.PercentilesUs[metric]
+			return float64(value) / usPerMs, ok
+		}, true
+	}
+	return nil, false
+}
+
+// Whether the rule condition holds for the output, and the compared value
+func (r *AlertRule) evaluate(c *ReportClientConfig, o *OutPutData) (bool, float64) {
+	value, ok := r.value(c, o)
+	return ok && r.breached(value, r.Threshold), value
+}
+
+// The built-in rules take their thresholds from the configuration of the entry
+func (r *AlertRule) forEntry(config *EntryConfig) *AlertRule {
+	if !r.builtin {
+		return r
+	}
+	rule := *r
+	if r.Type == SLOW {
+		rule.Threshold, rule.For, rule.Recover = config.FastRate, config.AlertForBadFastRateReachedTimes, config.AlertForGreatFastRateReachedTimes
+	} else {
+		rule.Threshold, rule.For, rule.Recover = config.SuccessRate, config.AlertForBadSuccessRateReachedTimes, config.AlertForGreatSuccessRateReachedTimes
+	}
+	return &rule
+}
@@ -0,0 +1,52 @@
+package monitor_tool
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAlertEventCallerTellsRulesApart(t *testing.T) {
+	events := make(chan *AlertEvent, 16)
+	types := make(chan AlertType, 16)
+	client, err := NewClient(ReportClientConfig{
+		Name:                     "rules",
+		StatisticalCycle:         10,
+		DisableDefaultOutput:     true,
+		DisableDefaultAlertRules: true,
+		AlertRules: []AlertRule{
+			{Name: "busy", Metric: "count", Op: ">=", Threshold: 1, For: 1},
+			{Name: "slowest", Metric: "maxMs", Op: ">", Threshold: 100, For: 1, Labels: map[string]string{"team": "db"}},
+		},
+		AlertCaller: func(clientName string, interfaceName string, alertType AlertType, recentOutputData []OutPutData) {
+			types <- alertType
+		},
+		AlertEventCaller: func(event *AlertEvent) { events <- event },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(context.Background())
+	client.Report("entry", 200, 200)
+	rules := map[string]*AlertEvent{}
+	for len(rules) < 2 {
+		select {
+		case event := <-events:
+			if event.Kind != ALERTING || event.InterfaceName != "entry" || event.AlertType != RULE {
+				t.Fatalf("unexpected event %+v", event)
+			}
+			rules[event.Rule] = event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only the events of %v arrived", rules)
+		}
+	}
+	if rules["busy"] == nil || rules["slowest"] == nil {
+		t.Fatalf("events of the rules %v, want busy and slowest", rules)
+	}
+	if team := rules["slowest"].RuleLabels["team"]; team != "db" {
+		t.Fatalf("the slowest event has the team %q, want db", team)
+	}
+	if alertType := <-types; alertType != RULE {
+		t.Fatalf("AlertCaller received %v, want RULE", alertType)
+	}
+}
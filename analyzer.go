@@ -1,6 +1,7 @@
 package monitor_tool
 
 import (
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -14,6 +15,8 @@ type OutPutData struct {
 	ClientName string `json:"clientName"`
 	// Interface Naming
 	InterfaceName string `json:"interfaceName"`
+	// Dimensional labels reported together with the interface, see ReportWithLabels
+	Labels map[string]string `json:"labels,omitempty"`
 	// Total number of calls
 	Count uint32 `json:"count"`
 	// Total number of successes
@@ -26,6 +29,11 @@ type OutPutData struct {
 	MaxMs uint32 `json:"maxMs"`
 	// Minimum time required for success
 	MinMs uint32 `json:"minMs"`
+	// The same three elapsed times in microseconds, the millisecond fields are rounded from them.
+	// They are only finer than the millisecond for the calls reported with ReportDuration
+	SuccessUsAver uint64 `json:"successUsAver"`
+	MaxUs         uint64 `json:"maxUs"`
+	MinUs         uint64 `json:"minUs"`
 	// Total number of time attainment
 	FastCount uint32 `json:"fastCount"`
 	// Time compliance rate
@@ -36,28 +44,63 @@ type OutPutData struct {
 	FailDistribution map[string]uint32 `json:"failDistribution"`
 	// Time delay distribution
 	TimeConsumingDistribution map[string]uint32 `json:"timeConsumingDistribution"`
+	// Reports of the client (all interfaces) dropped by the overflow policy during this cycle,
+	//when not 0 the figures of the cycle are incomplete
+	DroppedCount uint64 `json:"droppedCount"`
+	// Estimated quantiles of the time taken for success, named p50, p99, p999... see EntryConfig.Percentiles
+	Percentiles map[string]uint32 `json:"percentiles,omitempty"`
+	// The same quantiles in microseconds
+	PercentilesUs map[string]uint64 `json:"percentilesUs,omitempty"`
 }
 
 // Store some recent state for alerting, recovery and other mechanisms
 type alertStatus struct {
 	recentAlertOutput   []OutPutData // The last few consecutive failed data
 	recentRecoverOutput []OutPutData // Several consecutive successful data since the most recent alarm
-	curState            AlertType    // Whether the current state is in the detection of recovery after an alarm
+	curState            AlertType    // Whether the current state is in the detection of recovery after an alarm, the type of the rule then
+}
+
+// Name of a failure code in OutPutData.FailDistribution
+func (c *ReportClientConfig) failName(status int) string {
+	var name string
+	if c.GetCodeFeature != nil {
+		_, name = c.GetCodeFeature(status)
+	} else if s, ok := c.CodeFeatureMap[status]; ok && s.Name != "" {
+		name = s.Name
+	}
+	if name != "" {
+		return name
+	}
+	return strings.Replace(c.DefaultFailDistributionFormat, "%code", strconv.Itoa(status), 1)
+}
+
+// Microseconds rounded to the nearest millisecond
+func usToMs(us uint64) uint32 {
+	return uint32((us + usPerMs/2) / usPerMs)
 }
 
 // Periodic start-up analysis tasks
 func (c *ReportClientConfig) scheduleTask() {
 	// Timed statistics
 	t := time.NewTicker(time.Duration(c.StatisticalCycle) * time.Millisecond)
-	for curTime := range t.C {
-		for _, collectData := range c.collectDataMap {
-			c.taskChannel <- &taskQueue{
+	defer t.Stop()
+	for {
+		select {
+		case curTime := <-t.C:
+			// collectDataMap belongs to the collector, one task clears all its entries
+			select {
+			case c.controlChannel <- &taskQueue{
 				taskType: CLEAR,
 				data: clearData{
-					Name: collectData.Name,
 					Time: curTime,
 				},
+			}:
+			case <-c.stopChannel:
+				return
 			}
+		case <-c.stopChannel:
+			// The collector performs the final flush
+			return
 		}
 	}
 }
@@ -66,159 +109,134 @@ func (c *ReportClientConfig) scheduleTask() {
 func (c *ReportClientConfig) statistics() {
 	// Statistical analysis in terms of specific entries
 	for collectedData := range c.statisticsChannel {
+		if collectedData.evicted {
+			c.forgetEntry(&collectedData)
+			continue
+		}
 		// Statistics of general indicators
 		outputData := OutPutData{}
 		outputData.ClientName = c.Name
 		outputData.InterfaceName = collectedData.Name
+		outputData.Labels = collectedData.Labels
 		outputData.Count = collectedData.FailCount + collectedData.SuccessCount
 		outputData.SuccessRate = float64(collectedData.SuccessCount) / float64(outputData.Count)
 		outputData.FastRate = float64(collectedData.FastCount) / float64(outputData.Count)
 		outputData.FastCount = collectedData.FastCount
-		outputData.SuccessMsAver = uint32(float64(collectedData.SuccessMsCount) / float64(outputData.Count))
+		// Only the successes have an elapsed time
+		if collectedData.SuccessCount > 0 {
+			outputData.SuccessUsAver = collectedData.SuccessUsCount / uint64(collectedData.SuccessCount)
+		}
+		outputData.SuccessMsAver = usToMs(outputData.SuccessUsAver)
 		outputData.SuccessCount = collectedData.SuccessCount
 		outputData.FailCount = collectedData.FailCount
-		outputData.MaxMs = collectedData.MaxMs
-		outputData.MinMs = collectedData.MinMs
+		outputData.MaxUs = collectedData.MaxUs
+		outputData.MinUs = collectedData.MinUs
+		outputData.MaxMs = usToMs(collectedData.MaxUs)
+		outputData.MinMs = usToMs(collectedData.MinUs)
 		outputData.Timestamp = collectedData.Time.UTC()
+		outputData.DroppedCount = collectedData.Dropped
 		outputData.TimeConsumingDistribution = map[string]uint32{}
 		outputData.FailDistribution = map[string]uint32{}
 
-		// Time delay distribution statistics
-		scope := (collectedData.Config.TimeConsumingDistributionMax - collectedData.Config.TimeConsumingDistributionMin) / uint32(collectedData.Config.TimeConsumingDistributionSplit-2)
-		// Calculate the first interval
-		outputData.TimeConsumingDistribution["<"+strconv.FormatUint(uint64(collectedData.Config.TimeConsumingDistributionMin), 10)] = collectedData.TimeConsumingDistribution[0]
-		// Calculate the last interval
-		outputData.TimeConsumingDistribution[">"+strconv.FormatUint(uint64(collectedData.Config.TimeConsumingDistributionMax), 10)] = collectedData.TimeConsumingDistribution[collectedData.Config.TimeConsumingDistributionSplit-1]
-		// Calculate the remaining interval
-		for i := 1; i < collectedData.Config.TimeConsumingDistributionSplit-1; i++ {
-			start := int(collectedData.Config.TimeConsumingDistributionMin + uint32(i-1)*scope)
-			var end int
-			if i == collectedData.Config.TimeConsumingDistributionSplit-1 {
-				end = int(collectedData.Config.TimeConsumingDistributionMax)
-			} else {
-				end = int(collectedData.Config.TimeConsumingDistributionMin + uint32(i)*scope)
+		// Time delay distribution statistics, the labels sort in the order of the intervals
+		for i, label := range collectedData.Config.bucketLabels {
+			outputData.TimeConsumingDistribution[label] = collectedData.TimeConsumingDistribution[i]
+		}
+
+		// Quantiles, clamped to the observed range since the sketch only knows buckets
+		if collectedData.sketch != nil && collectedData.SuccessCount > 0 {
+			outputData.Percentiles = make(map[string]uint32, len(collectedData.Config.Percentiles))
+			outputData.PercentilesUs = make(map[string]uint64, len(collectedData.Config.Percentiles))
+			for i, q := range collectedData.Config.Percentiles {
+				value := uint64(math.Round(collectedData.sketch.quantile(q)))
+				if value < collectedData.MinUs {
+					value = collectedData.MinUs
+				} else if value > collectedData.MaxUs {
+					value = collectedData.MaxUs
+				}
+				outputData.PercentilesUs[collectedData.Config.percentileNames[i]] = value
+				outputData.Percentiles[collectedData.Config.percentileNames[i]] = usToMs(value)
 			}
-			outputData.TimeConsumingDistribution[strconv.Itoa(start)+"~"+strconv.Itoa(end)] = collectedData.TimeConsumingDistribution[i]
 		}
 
 		// Failure distribution statistics
 		for status, count := range collectedData.FailDistribution {
-			var name string
-			if c.GetCodeFeature != nil {
-				_, name = c.GetCodeFeature(status)
-			} else if s, ok := c.CodeFeatureMap[status]; ok && s.Name != "" {
-				name = s.Name
-			}
-			if name != "" {
-				outputData.FailDistribution[name] = count
-			} else {
-				outputData.FailDistribution[strings.Replace(c.DefaultFailDistributionFormat, "%code", strconv.Itoa(status), 1)] = count
-			}
+			outputData.FailDistribution[c.failName(status)] = count
 		}
 
-		// Alarm analysis: Since alarm analysis has the possibility of calling customized alarm functions,
-		//performance cannot be predicted,
-		//so new goroutine is enabled to perform to avoid unpredictable risks
-		go c.alertAnalyze(collectedData.Name, outputData)
+		// Alarm analysis: the statistics goroutine owns the alarm status of every entry, so the periods
+		//of an entry are analyzed one after another in order. Customized alarm functions, whose performance
+		//cannot be predicted, are not called here but queued to the alert caller goroutine
+		if !collectedData.skipAlert {
+			c.alertAnalyze(collectedData.Key, collectedData.Config, outputData)
+		}
 
+		// Alert groups only exist for the analysis above
+		if collectedData.skipOutput {
+			continue
+		}
+		c.updateMetrics(&collectedData, &outputData)
 		// Output final statistics
 		if c.OutputCaller != nil {
 			// Similarly, any external custom function
 			//calls should be executed with a new goroutine enabled
-			go c.OutputCaller(&outputData)
+			c.callerWaitGroup.Add(1)
+			go func(outputData *OutPutData) {
+				defer c.callerWaitGroup.Done()
+				c.OutputCaller(outputData)
+			}(&outputData)
 		}
-		defaultOutputCaller(&outputData)
+		c.defaultOutputCaller(&outputData)
 	}
+	// Shutting down: wait for the custom callers that are still running
+	c.alertCallQueue.close()
+	c.callerWaitGroup.Wait()
+	c.stopNotifiers()
+	unregisterClient(c)
+	close(c.doneChannel)
 }
 
 // Alarm-related analysis
-func (c *ReportClientConfig) alertAnalyze(entryName string, outputData OutPutData) {
-	// Latency compliance alarm and recovery analysis
-	if _, ok := c.recentFastRateStatus[entryName]; !ok {
-		c.recentFastRateStatus[entryName] = &alertStatus{
-			recentAlertOutput: make([]OutPutData, 0),
-		}
+// The alarm status is kept per entry key and per rule, so that every label set (or alert group) is analyzed on its own
+func (c *ReportClientConfig) alertAnalyze(key string, config *EntryConfig, outputData OutPutData) {
+	statuses := c.alertStatusMap[key]
+	if statuses == nil {
+		statuses = make([]alertStatus, len(c.alertRules))
+		c.alertStatusMap[key] = statuses
 	}
-	curFastRateStatus := c.recentFastRateStatus[entryName]
-	if _, ok := c.recentSuccessRateStatus[entryName]; !ok {
-		c.recentSuccessRateStatus[entryName] = &alertStatus{
-			recentAlertOutput: make([]OutPutData, 0),
-		}
+	for i := range c.alertRules {
+		c.ruleAnalyze(key, c.alertRules[i].forEntry(config), &statuses[i], outputData)
 	}
-	curSuccessRateStatus := c.recentSuccessRateStatus[entryName]
-	// Latency non-compliance alerts only trigger statistics when there are successful requests
-	if outputData.SuccessCount > 0 && outputData.FastRate < c.FastRate {
+}
+
+func (c *ReportClientConfig) ruleAnalyze(key string, rule *AlertRule, status *alertStatus, outputData OutPutData) {
+	if breached, _ := rule.evaluate(c, &outputData); breached {
 		// Each failure will reset the recovery count
-		if len(curFastRateStatus.recentRecoverOutput) > 0 {
-			curFastRateStatus.recentRecoverOutput = curFastRateStatus.recentRecoverOutput[:0]
+		if len(status.recentRecoverOutput) > 0 {
+			status.recentRecoverOutput = status.recentRecoverOutput[:0]
 		}
-		curFastRateStatus.recentAlertOutput = append(curFastRateStatus.recentAlertOutput, outputData)
-		if curFastRateStatus.curState == NONE && len(curFastRateStatus.recentAlertOutput) >= c.AlertForBadFastRateReachedTimes {
+		status.recentAlertOutput = append(status.recentAlertOutput, outputData)
+		if status.curState == NONE && len(status.recentAlertOutput) >= rule.For {
 			// Mark the status of the current alarm
-			curFastRateStatus.curState = SLOW
-			if c.AlertCaller != nil {
-				c.AlertCaller(c.Name, entryName, SLOW, curFastRateStatus.recentAlertOutput)
-			} else {
-				defaultAlert(c.Name, entryName, SLOW, curFastRateStatus.recentAlertOutput)
-			}
-			curFastRateStatus.recentAlertOutput = curFastRateStatus.recentAlertOutput[:0]
+			status.curState = rule.Type
+			c.updateAlertMetrics(key, &outputData, rule, true)
+			c.notify(key, ALERTING, rule, &outputData, status.recentAlertOutput)
+			status.recentAlertOutput = status.recentAlertOutput[:0]
 		}
 	} else {
 		// As long as a success to clear the original unhealthy records, the performance is
 		//slightly better than judging whether the length is greater than 0 before clearing
-		curFastRateStatus.recentAlertOutput = curFastRateStatus.recentAlertOutput[:0]
+		status.recentAlertOutput = status.recentAlertOutput[:0]
 		//  When in alarm status, the number of recoveries is accumulated for each success
-		if curFastRateStatus.curState == SLOW {
-			curFastRateStatus.recentRecoverOutput = append(curFastRateStatus.recentRecoverOutput, outputData)
-			if len(curFastRateStatus.recentRecoverOutput) >= c.AlertForGreatFastRateReachedTimes {
+		if status.curState != NONE {
+			status.recentRecoverOutput = append(status.recentRecoverOutput, outputData)
+			if len(status.recentRecoverOutput) >= rule.Recover {
 				// Trigger recovery notification
-				if c.RecoverCaller != nil {
-					c.RecoverCaller(c.Name, entryName, SLOW, curFastRateStatus.recentRecoverOutput)
-				} else {
-					defaultRecover(c.Name, entryName, SLOW, curFastRateStatus.recentRecoverOutput)
-				}
-				// Reset flag
-				curFastRateStatus.curState = NONE
-				curFastRateStatus.recentAlertOutput = curFastRateStatus.recentAlertOutput[:0]
-			}
-		}
-	}
-
-	// Access success rate alert and recovery analysis
-	if outputData.SuccessRate < c.SuccessRate {
-		// Each failure will reset the recovery count
-		if len(curSuccessRateStatus.recentRecoverOutput) > 0 {
-			curSuccessRateStatus.recentRecoverOutput = curSuccessRateStatus.recentRecoverOutput[:0]
-		}
-		curSuccessRateStatus.recentAlertOutput = append(curSuccessRateStatus.recentAlertOutput, outputData)
-		if curSuccessRateStatus.curState == NONE && len(curSuccessRateStatus.recentAlertOutput) >= c.AlertForBadSuccessRateReachedTimes {
-			// Mark the status of the current alarm
-			curSuccessRateStatus.curState = FAIL
-			// Trigger the alarm of continuous time consumption not meeting the standard
-			if c.AlertCaller != nil {
-				c.AlertCaller(c.Name, entryName, FAIL, curSuccessRateStatus.recentAlertOutput)
-			} else {
-				defaultAlert(c.Name, entryName, FAIL, curSuccessRateStatus.recentAlertOutput)
-			}
-			curSuccessRateStatus.recentAlertOutput = curSuccessRateStatus.recentAlertOutput[:0]
-		}
-	} else {
-		// Just one success to clear the original unhealthy record
-		curSuccessRateStatus.recentAlertOutput = curSuccessRateStatus.recentAlertOutput[:0]
-		//  When in alarm status, the number
-		// of recoveries is accumulated for each success
-		if curSuccessRateStatus.curState == FAIL {
-			curSuccessRateStatus.recentRecoverOutput = append(curSuccessRateStatus.recentRecoverOutput, outputData)
-			if len(curSuccessRateStatus.recentRecoverOutput) >= c.AlertForGreatSuccessRateReachedTimes {
-				// Trigger recovery notification
-				if c.RecoverCaller != nil {
-					c.RecoverCaller(c.Name, entryName, FAIL, curSuccessRateStatus.recentRecoverOutput)
-				} else {
-					defaultRecover(c.Name, entryName, FAIL, curSuccessRateStatus.recentRecoverOutput)
-				}
+				c.notify(key, RECOVERED, rule, &outputData, status.recentRecoverOutput)
 				// Reset flag
-				curSuccessRateStatus.curState = NONE
-				curSuccessRateStatus.recentAlertOutput = curSuccessRateStatus.recentAlertOutput[:0]
+				status.curState = NONE
+				c.updateAlertMetrics(key, &outputData, rule, false)
+				status.recentRecoverOutput = status.recentRecoverOutput[:0]
 			}
 		}
 	}
@@ -0,0 +1,209 @@
+package monitor_tool
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Register a client that collects its outputs, closed at the end of the test
+func collectingClient(t *testing.T, config ReportClientConfig) (ReportClient, func() []OutPutData) {
+	t.Helper()
+	var lock sync.Mutex
+	var outputs []OutPutData
+	config.DisableDefaultOutput = true
+	config.OutputCaller = func(o *OutPutData) {
+		lock.Lock()
+		outputs = append(outputs, *o)
+		lock.Unlock()
+	}
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close(context.Background()) })
+	return client, func() []OutPutData {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]OutPutData(nil), outputs...)
+	}
+}
+
+func TestMillisecondsAreRounded(t *testing.T) {
+	client, outputs := collectingClient(t, ReportClientConfig{Name: "rounding", StatisticalCycle: 60000})
+	client.ReportDuration("entry", 1600*time.Microsecond, 200)
+	client.ReportDuration("entry", 1800*time.Microsecond, 200)
+	client.ReportDuration("entry", 2400*time.Microsecond, 200)
+	if err := client.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := outputs()
+	if len(got) != 1 {
+		t.Fatalf("%d outputs, want 1", len(got))
+	}
+	if o := got[0]; o.SuccessUsAver != 1933 || o.SuccessMsAver != 2 || o.MinMs != 2 || o.MaxMs != 2 {
+		t.Fatalf("SuccessUsAver %d, SuccessMsAver %d, MinMs %d, MaxMs %d, want 1933, 2, 2 and 2", o.SuccessUsAver, o.SuccessMsAver, o.MinMs, o.MaxMs)
+	}
+}
+
+func TestSuccessAverageLeavesFailuresOut(t *testing.T) {
+	client, outputs := collectingClient(t, ReportClientConfig{Name: "average", StatisticalCycle: 60000})
+	client.ReportDuration("entry", 10*time.Millisecond, 200)
+	client.ReportDuration("entry", 20*time.Millisecond, 200)
+	client.ReportDuration("entry", 0, 500)
+	client.ReportDuration("entry", 0, 500)
+	if err := client.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := outputs()
+	if len(got) != 1 {
+		t.Fatalf("%d outputs, want 1", len(got))
+	}
+	o := got[0]
+	if o.SuccessUsAver != 15000 || o.SuccessMsAver != 15 {
+		t.Fatalf("SuccessUsAver %d, SuccessMsAver %d, want 15000 and 15", o.SuccessUsAver, o.SuccessMsAver)
+	}
+	value, _ := alertMetric("successMsAver")
+	if average, ok := value(&ReportClientConfig{}, &o); !ok || average != 15 {
+		t.Fatalf("the successMsAver rule metric is %v (%v), want 15", average, ok)
+	}
+}
+
+type stressAlarm struct {
+	interfaceName string
+	alertType     AlertType
+	recovery      bool
+}
+
+// Reporters alternate between phases of fast successes and of slow failures, long enough for every entry to
+// raise and recover both alarms again and again, while the alarm and recovery callers are slow
+func TestAlarmStress(t *testing.T) {
+	for _, shards := range []int{0, 4} {
+		t.Run("shards="+strconv.Itoa(shards), func(t *testing.T) {
+			alarmStress(t, shards)
+		})
+	}
+}
+
+func alarmStress(t *testing.T, shards int) {
+	var outputCount atomic.Int64
+	var lock sync.Mutex
+	var alarms []stressAlarm
+	stalled := make(chan string, 1)
+	var first sync.Once
+	record := func(recovery bool) func(string, string, AlertType, []OutPutData) {
+		return func(clientName string, interfaceName string, alertType AlertType, recentOutputData []OutPutData) {
+			lock.Lock()
+			alarms = append(alarms, stressAlarm{interfaceName: interfaceName, alertType: alertType, recovery: recovery})
+			lock.Unlock()
+			// The first call waits for outputs, which the statistics produce without waiting for it
+			first.Do(func() {
+				from := outputCount.Load()
+				deadline := time.Now().Add(5 * time.Second)
+				for outputCount.Load() < from+20 {
+					if time.Now().After(deadline) {
+						stalled <- "no output while the alarm caller was running"
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+			})
+			time.Sleep(2 * time.Millisecond)
+		}
+	}
+	client, err := NewClient(ReportClientConfig{
+		Name:                 "stress",
+		StatisticalCycle:     5,
+		CollectorShards:      shards,
+		DisableDefaultOutput: true,
+		OutputCaller:         func(o *OutPutData) { outputCount.Add(1) },
+		AlertCaller:          record(false),
+		RecoverCaller:        record(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	bad := func() bool {
+		return time.Since(start)/(50*time.Millisecond)%2 == 1
+	}
+	var reporters sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		reporters.Add(1)
+		go func(i int) {
+			defer reporters.Done()
+			name := "plain-" + strconv.Itoa(i%4)
+			labels := map[string]string{"zone": strconv.Itoa(i % 2)}
+			for n := 0; ; n++ {
+				// Half of the bad calls fail, the other half are slow
+				ms, code := uint32(1), 200
+				if bad() {
+					ms = 900
+					if n%2 == 0 {
+						code = 500
+					}
+				}
+				var err error
+				if i%2 == 0 {
+					err = client.Report(name, ms, code)
+				} else {
+					err = client.ReportWithLabels("labeled-"+strconv.Itoa(i%4), labels, ms, code)
+				}
+				if errors.Is(err, ErrClientClosed) {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				time.Sleep(50 * time.Microsecond)
+			}
+		}(i)
+	}
+	time.Sleep(time.Second)
+	// Concurrent calls to Close all wait for the shutdown
+	var closers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		closers.Add(1)
+		go func() {
+			defer closers.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := client.Close(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	closers.Wait()
+	reporters.Wait()
+	select {
+	case reason := <-stalled:
+		t.Fatal(reason)
+	default:
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(alarms) == 0 {
+		t.Fatal("no alarm was raised")
+	}
+	// Alarms and recoveries of an entry and a type alternate, starting with an alarm
+	raised := map[string]bool{}
+	count := map[AlertType]int{}
+	for _, alarm := range alarms {
+		key := alarm.interfaceName + "/" + alarm.alertType.String()
+		if alarm.recovery != raised[key] {
+			t.Fatalf("%s: alarm and recovery out of order in %v", key, alarms)
+		}
+		raised[key] = !alarm.recovery
+		if !alarm.recovery {
+			count[alarm.alertType]++
+		}
+	}
+	if count[FAIL] < 8 || count[SLOW] < 8 {
+		t.Fatalf("%d FAIL and %d SLOW alarms raised, the phases did not alternate", count[FAIL], count[SLOW])
+	}
+}
@@ -0,0 +1,34 @@
+package monitor_tool
+
+// Synthetic codes of the calls that got no response or returned an error, they are failures named through
+// CodeFeatureMap
+const (
+	// CODE_NETWORK Any other transport error: connection refused or reset, malformed response...
+	CODE_NETWORK = -1 - iota
+	// CODE_TIMEOUT A deadline was exceeded, of the context or of the client
+	CODE_TIMEOUT
+	// CODE_DNS The host name could not be resolved
+	CODE_DNS
+	// CODE_CANCELED The context of the call was canceled
+	CODE_CANCELED
+	// CODE_TLS The TLS handshake or the certificate verification failed
+	CODE_TLS
+	// CODE_ERROR Any other error returned by an operation, see Observe
+	CODE_ERROR
+	// CODE_BAD_CONN The database connection was unusable (driver.ErrBadConn), database/sql retries on another one
+	CODE_BAD_CONN
+	// CODE_NO_ROWS The query returned no rows (sql.ErrNoRows)
+	CODE_NO_ROWS
+)
+
+// Names of the synthetic codes, added to CodeFeatureMap unless it already has the code
+var syntheticCodeFeatures = map[int]CodeFeature{
+	CODE_NETWORK:  {Name: "network error"},
+	CODE_TIMEOUT:  {Name: "timeout"},
+	CODE_DNS:      {Name: "dns error"},
+	CODE_CANCELED: {Name: "canceled"},
+	CODE_TLS:      {Name: "tls error"},
+	CODE_ERROR:    {Name: "error"},
+	CODE_BAD_CONN: {Name: "bad connection"},
+	CODE_NO_ROWS:  {Name: "no rows"},
+}
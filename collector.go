@@ -1,17 +1,31 @@
 package monitor_tool
 
-import "time"
+import (
+	"runtime"
+	"strings"
+	"time"
+)
 
 // Every piece of reported data flows into the collection module, which only does some simple data logging
 type reportData struct {
 	// Unique naming of entries
 	Name string
-	// Total time taken for success
-	SuccessMsCount uint64
-	// Maximum time taken for success
-	MaxMs uint32
-	// Minimum time required for success
-	MinMs uint32
+	// Labels of the entry, nil when reported without labels
+	Labels map[string]string
+	// Key of the entry in collectDataMap, the name combined with the canonical label set
+	Key string
+	// The entry only feeds the output, its alerts are analyzed through an alert group
+	skipAlert bool
+	// The entry is an alert group, it is only analyzed and never output
+	skipOutput bool
+	// Total time taken for success, in microseconds
+	SuccessUsCount uint64
+	// Maximum time taken for success, in microseconds
+	MaxUs uint64
+	// Minimum time required for success, in microseconds, only meaningful once minSet.
+	// A fast call may well take 0, so 0 cannot stand for an unset minimum
+	MinUs  uint64
+	minSet bool
 	// Total number of successes
 	SuccessCount uint32
 	// Total number of time attainment
@@ -22,140 +36,360 @@ type reportData struct {
 	FailDistribution map[int]uint32
 	// Time delay distribution
 	TimeConsumingDistribution []uint32
+	// Quantile sketch of the elapsed time of successes, nil when percentiles are disabled
+	sketch *quantileSketch
 	// Configuration of entries
 	Config *EntryConfig
 	// Time of this count
 	Time time.Time
+	// Reports of the client dropped by the overflow policy during this cycle
+	Dropped uint64
+	// Consecutive cycles without any report, and the end of the last cycle with reports
+	idleCycles int
+	lastActive time.Time
+	// The entry has been evicted, the data only tells the analysis to forget it
+	evicted bool
 }
 
 // EntryConfig More detailed configuration related to item statistics
 type EntryConfig struct {
-	// The maximum time taken for time attainment, default is 500ms
+	// The maximum time taken for time attainment, in TimeUnit, default is 500ms
 	FastLessThan uint32
-	// The number of intervals in the time consumption distribution, the default is 10, at least 3, at most 20
+	// Unit of FastLessThan and of the boundaries of the time consumption distribution, a whole number of
+	//microseconds, the default is time.Millisecond. Use time.Microsecond for entries faster than a millisecond
+	TimeUnit time.Duration
+	// How the boundaries of the time consumption distribution are laid out, the default is LINEAR.
+	// Whatever the strategy, an interval includes its upper boundary like a Prometheus le bucket: the first
+	//interval counts the elapsed times up to the first boundary and the last one those above the last boundary
+	TimeConsumingDistributionStrategy BucketStrategy
+	// LINEAR only: the number of intervals in the time consumption distribution, the default is 10, at least 3
 	// The first interval is used to mark the number of intervals less than TimeConsumingMin
 	// The last interval is used to mark the number of intervals greater than TimeConsumingMax
 	// the remaining (TimeConsumingDistributionSplit - 2) intervals, in the range (MaxConsumingMin)/(Number of intervals - 2)
 	TimeConsumingDistributionSplit int
-	TimeConsumingDistributionMax   uint32
-	TimeConsumingDistributionMin   uint32
-	timeConsumingRange             uint32
+	// LINEAR and EXPONENTIAL: the last and the first boundary
+	TimeConsumingDistributionMax uint32
+	TimeConsumingDistributionMin uint32
+	// EXPONENTIAL only: the ratio between two consecutive boundaries, greater than 1, the default is 2
+	TimeConsumingDistributionFactor float64
+	// EXPLICIT only: the sorted upper bounds of the intervals
+	TimeConsumingDistributionBounds []uint32
+	// Resolved boundaries in microseconds and the sortable labels, in TimeUnit, of the len(bounds)+1 intervals
+	boundsUs       []uint64
+	bucketLabels   []string
+	fastLessThanUs uint64
+	// Quantiles of the elapsed time of successes emitted in OutPutData.Percentiles, each in (0, 1) and with
+	// a name of its own (0.999 and 0.0999 are both p999). The default is 0.5, 0.9, 0.99 and 0.999
+	Percentiles []float64
+	// Relative accuracy of the estimated quantiles, the default is 0.01 (1%).
+	// Memory per entry is bounded by about log(maxUs)/log((1+a)/(1-a)) counters for elapsed times up to
+	// maxUs microseconds, about 1450 at the default accuracy for the longest elapsed time a report can carry
+	PercentileAccuracy float64
+	// Do not keep a quantile sketch for the entry
+	DisablePercentiles bool
+	percentileNames    []string
+	// Thresholds of the built-in FAIL and SLOW alarms for the entry, the defaults are the values of
+	//the same fields of ReportClientConfig
+	SuccessRate                          float64
+	FastRate                             float64
+	AlertForBadSuccessRateReachedTimes   int
+	AlertForBadFastRateReachedTimes      int
+	AlertForGreatSuccessRateReachedTimes int
+	AlertForGreatFastRateReachedTimes    int
 }
 
 var defaultEntryConfig = &EntryConfig{
 	FastLessThan:                   500,
+	TimeUnit:                       time.Millisecond,
+	fastLessThanUs:                 500 * usPerMs,
 	TimeConsumingDistributionSplit: 10,
 	TimeConsumingDistributionMax:   500,
 	TimeConsumingDistributionMin:   100,
-	timeConsumingRange:             (500 - 100) / (10 - 2),
+	Percentiles:                    []float64{0.5, 0.9, 0.99, 0.999},
+	PercentileAccuracy:             0.01,
+	percentileNames:                []string{"p50", "p90", "p99", "p999"},
 }
 
+func init() {
+	defaultEntryConfig.normalizeDistribution(&configChecker{})
+}
+
+// The resolved configuration is cached per name, patterns are only matched the first time a name is seen
+// after a configuration change
 func (c *ReportClientConfig) getEntryConfig(name string) *EntryConfig {
+	c.entryConfigLock.RLock()
+	entryConfig, ok := c.entryConfigCache[name]
+	c.entryConfigLock.RUnlock()
+	if ok {
+		return entryConfig
+	}
+	c.entryConfigLock.Lock()
+	defer c.entryConfigLock.Unlock()
 	if curEntryConfig, ok := c.entryConfigMap[name]; ok {
-		return &curEntryConfig
+		entryConfig = &curEntryConfig
+	} else if entryConfig = c.matchEntryConfigPattern(name); entryConfig == nil {
+		entryConfig = c.defaultEntryConfig
 	}
-	return defaultEntryConfig
+	c.entryConfigCache[name] = entryConfig
+	return entryConfig
 }
 
+// AddEntryConfig Out-of-range values are replaced by defaults, a maximum elapsed time not greater than
+// the minimum causes a panic
 func (c *ReportClientConfig) AddEntryConfig(name string, entryConfig EntryConfig) {
-	if entryConfig.FastLessThan <= 0 {
-		entryConfig.FastLessThan = 500
-	}
-	if entryConfig.TimeConsumingDistributionSplit < 3 || entryConfig.TimeConsumingDistributionSplit > 20 {
-		entryConfig.TimeConsumingDistributionSplit = 10
+	if err := c.setEntryConfig(name, entryConfig, &configChecker{}); err != nil {
+		panic(err)
 	}
-	if entryConfig.TimeConsumingDistributionMax <= 0 {
-		entryConfig.TimeConsumingDistributionMax = 500
-	}
-	if entryConfig.TimeConsumingDistributionMin <= 0 {
-		entryConfig.TimeConsumingDistributionMin = 50
-	}
-	if entryConfig.TimeConsumingDistributionMax <= entryConfig.TimeConsumingDistributionMin {
-		panic("The maximum elapsed time must be greater than the minimum elapsed time")
+}
+
+// SetEntryConfig See ReportClient.SetEntryConfig
+func (c *ReportClientConfig) SetEntryConfig(name string, entryConfig EntryConfig) error {
+	return c.setEntryConfig(name, entryConfig, &configChecker{strict: true})
+}
+
+func (c *ReportClientConfig) setEntryConfig(name string, entryConfig EntryConfig, k *configChecker) error {
+	k.entry = name
+	entryConfig.normalize(k, c.defaultEntryConfig)
+	if err := k.err(); err != nil {
+		return err
 	}
-	entryConfig.timeConsumingRange = (entryConfig.TimeConsumingDistributionMax - entryConfig.TimeConsumingDistributionMin) / uint32(entryConfig.TimeConsumingDistributionSplit-2)
+	c.entryConfigLock.Lock()
 	c.entryConfigMap[name] = entryConfig
+	c.entryConfigCache = map[string]*EntryConfig{}
+	c.entryConfigLock.Unlock()
+	return nil
 }
 
 // Collection
 func (c *ReportClientConfig) collect() {
-	// Listening to this client's uplink channel
-	for t := range c.taskChannel {
-		if t.taskType == SERVER {
-			curReportServerData := t.data.(reportServer)
-			c.serverTask(&curReportServerData)
-
-		} else if t.taskType == CLEAR {
-			curClearData := t.data.(clearData)
-			c.clearTask(&curClearData)
+	// Listening to this client's uplink channel, and to the periodic tasks
+	for {
+		select {
+		case t := <-c.controlChannel:
+			c.runTask(t)
+			continue
+		case t := <-c.taskChannel:
+			c.runTask(t)
+			continue
+		case <-c.stopChannel:
+		}
+		break
+	}
+	c.drainTasks()
+	// Flush every entry as a final cycle so that the last partial period is not lost
+	c.clearTask(&clearData{
+		Time:  time.Now(),
+		final: true,
+	})
+	close(c.statisticsChannel)
+}
+
+// After Close, the reports in progress either reach the task channel or give up, the collector
+// keeps receiving until none is left
+func (c *ReportClientConfig) drainTasks() {
+	for {
+		select {
+		case t := <-c.taskChannel:
+			c.runTask(t)
+			continue
+		default:
 		}
+		// A report leaves after its task is in the channel
+		if c.shutdown.senders.Load() == 0 && len(c.taskChannel) == 0 {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+func (c *ReportClientConfig) runTask(t *taskQueue) {
+	if t.taskType == SERVER {
+		curReportServerData := t.data.(reportServer)
+		c.serverTask(&curReportServerData)
+
+	} else if t.taskType == CLEAR {
+		curClearData := t.data.(clearData)
+		c.clearTask(&curClearData)
+	} else if t.taskType == BATCH {
+		c.batchTask(t.data.([]AggregatedReport))
 	}
 }
 
+// The collector owns collectDataMap, a single CLEAR task closes the cycle of every entry
 func (c *ReportClientConfig) clearTask(curClearData *clearData) {
-	curCollectData := c.collectDataMap[curClearData.Name]
+	// Reports dropped during the cycle are stamped on every output of the cycle
+	dropped := c.counters.periodDropped.Swap(0)
+	c.mergeShards()
+	c.closeEventWindows(curClearData, dropped)
+	var evictedNames map[string]struct{}
+	for _, curCollectData := range c.collectDataMap {
+		if c.clearEntry(curCollectData, curClearData.Time, dropped) {
+			continue
+		}
+		// Entries without reports for EvictAfterCycles cycles are forgotten
+		curCollectData.idleCycles++
+		if c.EvictAfterCycles > 0 && curCollectData.idleCycles >= c.EvictAfterCycles && !curClearData.final {
+			c.evictEntry(curCollectData, curClearData.Time)
+			if evictedNames == nil {
+				evictedNames = map[string]struct{}{}
+			}
+			evictedNames[curCollectData.Name] = struct{}{}
+		}
+	}
+	if evictedNames != nil {
+		c.releaseNames(evictedNames)
+	}
+}
+
+// false when the entry had no report during the cycle
+func (c *ReportClientConfig) clearEntry(curCollectData *reportData, curTime time.Time, dropped uint64) bool {
 	if curCollectData.SuccessCount != 0 || curCollectData.FailCount != 0 {
+		curCollectData.idleCycles = 0
+		curCollectData.lastActive = curTime
 		collectedData := *curCollectData
-		collectedData.Time = curClearData.Time
+		collectedData.Time = curTime
+		collectedData.Dropped = dropped
 		// A copy of the data flows into the analysis
 		c.statisticsChannel <- collectedData
-		curCollectData.MinMs = 0
-		curCollectData.MaxMs = 0
+		curCollectData.MinUs = 0
+		curCollectData.minSet = false
+		curCollectData.MaxUs = 0
 		curCollectData.FailCount = 0
 		curCollectData.SuccessCount = 0
-		curCollectData.SuccessMsCount = 0
+		curCollectData.SuccessUsCount = 0
 		curCollectData.FastCount = 0
 		curCollectData.FailDistribution = map[int]uint32{}
-		curCollectData.TimeConsumingDistribution = make([]uint32, curCollectData.Config.TimeConsumingDistributionSplit)
+		curCollectData.TimeConsumingDistribution = make([]uint32, len(curCollectData.Config.bucketLabels))
+		if curCollectData.sketch != nil {
+			curCollectData.sketch = newQuantileSketch(curCollectData.Config.PercentileAccuracy)
+		}
+		return true
 	}
+	return false
 }
 
 func (c *ReportClientConfig) serverTask(curReportServerData *reportServer) {
-	if c.collectDataMap[curReportServerData.Name] == nil {
-		c.collectDataMap[curReportServerData.Name] = &reportData{
-			Name:             curReportServerData.Name,
-			Config:           c.getEntryConfig(curReportServerData.Name),
-			FailDistribution: map[int]uint32{},
+	success := c.codeSuccess(curReportServerData.Code)
+	collectDataMap := c.collectDataMap
+	if !curReportServerData.Time.IsZero() {
+		if collectDataMap = c.eventWindow(curReportServerData.Time); collectDataMap == nil {
+			return
 		}
 	}
-	curCollectData := c.collectDataMap[curReportServerData.Name]
-	if curCollectData.TimeConsumingDistribution == nil {
-		curCollectData.TimeConsumingDistribution = make([]uint32, curCollectData.Config.TimeConsumingDistributionSplit)
+	seriesData, groupData := c.targetData(collectDataMap, curReportServerData.Name, curReportServerData.Labels)
+	c.record(seriesData, curReportServerData, success)
+	if groupData != nil {
+		c.record(groupData, curReportServerData, success)
 	}
-	var success bool
+}
+
+// The data a report of the series counts into, and the data of its alert group when alerts are grouped
+func (c *ReportClientConfig) targetData(collectDataMap map[string]*reportData, name string, labels map[string]string) (*reportData, *reportData) {
+	key := labelKey(name, labels)
+	if c.AlertLabels == nil {
+		return c.getCollectData(collectDataMap, key, name, labels), nil
+	}
+	// Alerts are grouped by a subset of the labels: the series itself is only output,
+	//and the same data is merged into its alert group, which is only analyzed
+	seriesData := c.getCollectData(collectDataMap, key, name, labels)
+	seriesData.skipAlert = true
+	groupLabels := selectLabels(labels, c.AlertLabels)
+	groupData := c.getCollectData(collectDataMap, alertGroupKeyPrefix+labelKey(name, groupLabels), name, groupLabels)
+	groupData.skipOutput = true
+	return seriesData, groupData
+}
+
+func (c *ReportClientConfig) codeSuccess(code int) bool {
 	if c.GetCodeFeature != nil {
-		success, _ = c.GetCodeFeature(curReportServerData.Code)
-	} else if s, ok := c.CodeFeatureMap[curReportServerData.Code]; ok {
-		success = s.Success
+		success, _ := c.GetCodeFeature(code)
+		return success
 	}
-	// Hit success status code
-	if success {
-		curCollectData.SuccessCount++
-		if curCollectData.MinMs == 0 {
-			curCollectData.MinMs = curReportServerData.Ms
-		} else if curReportServerData.Ms < curCollectData.MinMs {
-			curCollectData.MinMs = curReportServerData.Ms
-		}
-		if curCollectData.MaxMs == 0 {
-			curCollectData.MaxMs = curReportServerData.Ms
-		} else if curReportServerData.Ms > curCollectData.MaxMs {
-			curCollectData.MaxMs = curReportServerData.Ms
-		}
-		curCollectData.SuccessMsCount += uint64(curReportServerData.Ms)
-		// Time consumed is less than the minimum of
-		//the interval Classified as the first interval
-		if curReportServerData.Ms < curCollectData.Config.TimeConsumingDistributionMin {
-			curCollectData.TimeConsumingDistribution[0] += 1
-		} else if curReportServerData.Ms >= curCollectData.Config.TimeConsumingDistributionMax {
-			curCollectData.TimeConsumingDistribution[curCollectData.Config.TimeConsumingDistributionSplit-1] += 1
+	return c.CodeFeatureMap[code].Success
+}
+
+// The data of an entry in collectDataMap, or in the map of an event time window
+func (c *ReportClientConfig) getCollectData(collectDataMap map[string]*reportData, key string, name string, labels map[string]string) *reportData {
+	if collectDataMap[key] == nil && c.MaxEntries > 0 && c.entryCount() >= c.MaxEntries {
+		// Beyond MaxEntries, new series are counted in the overflow entry, and new alert groups in its group
+		name, labels = c.OtherName, nil
+		if strings.HasPrefix(key, alertGroupKeyPrefix) {
+			key = alertGroupKeyPrefix + name
 		} else {
-			curCollectData.TimeConsumingDistribution[(curReportServerData.Ms-curCollectData.Config.TimeConsumingDistributionMin)/curCollectData.Config.timeConsumingRange+1] += 1
+			key = name
 		}
-		if curReportServerData.Ms <= curCollectData.Config.FastLessThan {
-			curCollectData.FastCount++
+	}
+	if collectDataMap[key] == nil {
+		collectDataMap[key] = &reportData{
+			Name:             name,
+			Labels:           labels,
+			Key:              key,
+			Config:           c.getEntryConfig(name),
+			FailDistribution: map[int]uint32{},
 		}
+		if !collectDataMap[key].Config.DisablePercentiles {
+			collectDataMap[key].sketch = newQuantileSketch(collectDataMap[key].Config.PercentileAccuracy)
+		}
+	}
+	return collectDataMap[key]
+}
+
+func (c *ReportClientConfig) record(curCollectData *reportData, curReportServerData *reportServer, success bool) {
+	if curCollectData.TimeConsumingDistribution == nil {
+		curCollectData.TimeConsumingDistribution = make([]uint32, len(curCollectData.Config.bucketLabels))
+	}
+	// Hit success status code
+	if success {
+		curCollectData.SuccessCount++
+		curCollectData.setMinMax(curReportServerData.Us, curReportServerData.Us)
+		curCollectData.SuccessUsCount += curReportServerData.Us
+		curCollectData.recordElapsed(curReportServerData.Us, 1)
 	} else {
 		curCollectData.FailCount++
 		curCollectData.FailDistribution[curReportServerData.Code]++
 	}
 }
+
+// Add the counts of another piece of data of the entry, which may have been collected with an older
+// configuration of the entry
+func (d *reportData) merge(o *reportData) {
+	if d.TimeConsumingDistribution == nil {
+		d.TimeConsumingDistribution = make([]uint32, len(d.Config.bucketLabels))
+	}
+	if o.minSet {
+		d.setMinMax(o.MinUs, o.MaxUs)
+	}
+	d.SuccessCount += o.SuccessCount
+	d.FastCount += o.FastCount
+	d.FailCount += o.FailCount
+	d.SuccessUsCount += o.SuccessUsCount
+	for code, n := range o.FailDistribution {
+		d.FailDistribution[code] += n
+	}
+	sameBounds := equalBounds(o.Config.boundsUs, d.Config.boundsUs)
+	for i, n := range o.TimeConsumingDistribution {
+		if sameBounds {
+			d.TimeConsumingDistribution[i] += n
+		} else if n > 0 {
+			// Counted in the interval of the lowest elapsed time of the original one
+			var lower uint64
+			if i > 0 {
+				lower = o.Config.boundsUs[i-1] + 1
+			}
+			d.TimeConsumingDistribution[d.Config.bucketIndex(lower)] += n
+		}
+	}
+	if d.sketch != nil {
+		d.sketch.merge(o.sketch)
+	}
+}
+
+// Widen the elapsed time range of the data to include [minUs, maxUs]
+func (d *reportData) setMinMax(minUs uint64, maxUs uint64) {
+	if !d.minSet || minUs < d.MinUs {
+		d.MinUs = minUs
+		d.minSet = true
+	}
+	if maxUs > d.MaxUs {
+		d.MaxUs = maxUs
+	}
+}
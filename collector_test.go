@@ -0,0 +1,76 @@
+package monitor_tool
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// Report failures and successes per label set and close the client, returning the labels of the alarms and of
+// the outputs
+func labeledAlarms(t *testing.T, alertLabels []string, reports map[string][2]int) (alarms []map[string]string, outputs []map[string]string) {
+	t.Helper()
+	var lock sync.Mutex
+	config := ReportClientConfig{
+		Name:                     "labels",
+		StatisticalCycle:         60000,
+		AlertLabels:              alertLabels,
+		DisableDefaultAlertRules: true,
+		AlertRules:               []AlertRule{{Name: "failures", Metric: "failCount", Op: ">=", Threshold: 3, For: 1}},
+		AlertEventCaller: func(event *AlertEvent) {
+			lock.Lock()
+			alarms = append(alarms, event.Labels)
+			lock.Unlock()
+		},
+	}
+	client, collected := collectingClient(t, config)
+	for series, counts := range reports {
+		labels := map[string]string{"upstream": series[:1], "tenant": series[1:]}
+		for i := 0; i < counts[0]; i++ {
+			client.ReportWithLabels("entry", labels, 1, 500)
+		}
+		for i := 0; i < counts[1]; i++ {
+			client.ReportWithLabels("entry", labels, 1, 200)
+		}
+	}
+	if err := client.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range collected() {
+		outputs = append(outputs, o.Labels)
+	}
+	byLabels := func(s []map[string]string) func(i, j int) bool {
+		return func(i, j int) bool { return labelKey("", s[i]) < labelKey("", s[j]) }
+	}
+	sort.Slice(alarms, byLabels(alarms))
+	sort.Slice(outputs, byLabels(outputs))
+	return alarms, outputs
+}
+
+func TestAlertLabelsGroupSeries(t *testing.T) {
+	// Failures and successes of the series named after their upstream and their tenant
+	reports := map[string][2]int{"ax": {2, 0}, "ay": {2, 5}, "bx": {2, 0}}
+	alarms, outputs := labeledAlarms(t, []string{"upstream"}, reports)
+	// Upstream a has 4 failures across its tenants, upstream b only 2
+	if want := []map[string]string{{"upstream": "a"}}; !reflect.DeepEqual(alarms, want) {
+		t.Fatalf("alarms of %v, want %v", alarms, want)
+	}
+	// The series are still output one by one
+	want := []map[string]string{{"tenant": "x", "upstream": "a"}, {"tenant": "x", "upstream": "b"}, {"tenant": "y", "upstream": "a"}}
+	if !reflect.DeepEqual(outputs, want) {
+		t.Fatalf("outputs of %v, want %v", outputs, want)
+	}
+	// An empty AlertLabels groups every series of the name
+	if alarms, _ := labeledAlarms(t, []string{}, reports); len(alarms) != 1 || len(alarms[0]) != 0 {
+		t.Fatalf("alarms of %v, want a single one without labels", alarms)
+	}
+}
+
+func TestSeriesAlertIndependently(t *testing.T) {
+	alarms, _ := labeledAlarms(t, nil, map[string][2]int{"ax": {2, 0}, "ay": {2, 0}, "bx": {3, 0}, "by": {0, 3}})
+	if want := []map[string]string{{"tenant": "x", "upstream": "b"}}; !reflect.DeepEqual(alarms, want) {
+		t.Fatalf("alarms of %v, want %v", alarms, want)
+	}
+}
@@ -0,0 +1,337 @@
+package monitor_tool
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigProblem A single invalid value found while validating a configuration
+type ConfigProblem struct {
+	// Name of the entry the field belongs to, empty for the fields of ReportClientConfig
+	Entry string
+	// Name of the offending field
+	Field string
+	// The rejected value
+	Value interface{}
+	// Why the value was rejected
+	Reason string
+}
+
+func (p ConfigProblem) String() string {
+	field := p.Field
+	if p.Entry != "" {
+		field = "entry " + strconv.Quote(p.Entry) + ": " + field
+	}
+	return fmt.Sprintf("%s = %v: %s", field, p.Value, p.Reason)
+}
+
+// ConfigError Collects every problem found in a configuration instead of stopping at the first one
+type ConfigError struct {
+	Problems []ConfigProblem
+}
+
+func (e *ConfigError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		problems[i] = p.String()
+	}
+	return "invalid report client configuration (" + strconv.Itoa(len(e.Problems)) + " problems): " + strings.Join(problems, "; ")
+}
+
+// AppliedDefault A field that was left unset, or was out of range in lenient mode, and received a default value.
+// A value that Register has always accepted but NewClient rejects is kept in lenient mode, with a Reason
+type AppliedDefault struct {
+	// Name of the entry the field belongs to, empty for the fields of ReportClientConfig
+	Entry string
+	Field string
+	Value interface{}
+	// Why the value kept in lenient mode is questionable, empty for the defaults
+	Reason string
+}
+
+// configChecker Accumulates problems and applied defaults. In strict mode out-of-range values are problems,
+// otherwise they are quietly replaced by the default as Register always did
+type configChecker struct {
+	strict   bool
+	entry    string
+	problems []ConfigProblem
+	defaults []AppliedDefault
+}
+
+func (k *configChecker) problem(field string, value interface{}, reason string) {
+	k.problems = append(k.problems, ConfigProblem{Entry: k.entry, Field: field, Value: value, Reason: reason})
+}
+
+func (k *configChecker) applied(field string, value interface{}) {
+	k.defaults = append(k.defaults, AppliedDefault{Entry: k.entry, Field: field, Value: value})
+}
+
+// A problem in strict mode, a value kept and reported among the applied defaults otherwise
+func (k *configChecker) questionable(field string, value interface{}, reason string) {
+	if k.strict {
+		k.problem(field, value, reason)
+		return
+	}
+	k.defaults = append(k.defaults, AppliedDefault{Entry: k.entry, Field: field, Value: value, Reason: reason})
+}
+
+// Zero takes the default, values outside [min, max] are problems in strict mode
+func (k *configChecker) checkInt(field string, value *int, def int, min int, max int) {
+	if *value == 0 {
+		*value = def
+		k.applied(field, def)
+	} else if *value < min || *value > max {
+		if k.strict {
+			if max == math.MaxInt {
+				k.problem(field, *value, "must be at least "+strconv.Itoa(min))
+			} else {
+				k.problem(field, *value, "must be between "+strconv.Itoa(min)+" and "+strconv.Itoa(max))
+			}
+			return
+		}
+		*value = def
+		k.applied(field, def)
+	}
+}
+
+// Rates are fractions, zero takes the default
+func (k *configChecker) checkRate(field string, value *float64, def float64) {
+	if *value == 0 {
+		*value = def
+		k.applied(field, def)
+	} else if math.IsNaN(*value) || *value < 0 || *value > 1 {
+		if k.strict {
+			k.problem(field, *value, "must be a fraction between 0 and 1")
+			return
+		}
+		*value = def
+		k.applied(field, def)
+	}
+}
+
+func (k *configChecker) checkUint32(field string, value *uint32, def uint32) {
+	if *value == 0 {
+		*value = def
+		k.applied(field, def)
+	}
+}
+
+func (k *configChecker) checkDuration(field string, value *time.Duration, def time.Duration) {
+	if *value == 0 {
+		*value = def
+		k.applied(field, def)
+	} else if *value < 0 {
+		if k.strict {
+			k.problem(field, *value, "must be positive")
+			return
+		}
+		*value = def
+		k.applied(field, def)
+	}
+}
+
+func (k *configChecker) err() error {
+	if len(k.problems) == 0 {
+		return nil
+	}
+	return &ConfigError{Problems: k.problems}
+}
+
+// Validate and complete the client level configuration, the entries of EntryConfigs included
+func (c *ReportClientConfig) normalize(k *configChecker) {
+	if c.Name == "" {
+		k.problem("Name", c.Name, "a name must be registered for this reporting type")
+	}
+	// Maximum of 5 minutes allowed for a statistical cycle
+	k.checkInt("StatisticalCycle", &c.StatisticalCycle, 60000, 1, 300000)
+	k.checkInt("AlertForBadSuccessRateReachedTimes", &c.AlertForBadSuccessRateReachedTimes, 3, 3, math.MaxInt)
+	k.checkInt("AlertForBadFastRateReachedTimes", &c.AlertForBadFastRateReachedTimes, 3, 3, math.MaxInt)
+	k.checkInt("AlertForGreatSuccessRateReachedTimes", &c.AlertForGreatSuccessRateReachedTimes, 3, 3, math.MaxInt)
+	k.checkInt("AlertForGreatFastRateReachedTimes", &c.AlertForGreatFastRateReachedTimes, 3, 3, math.MaxInt)
+	k.checkRate("SuccessRate", &c.SuccessRate, 0.95)
+	k.checkRate("FastRate", &c.FastRate, 0.8)
+	k.checkInt("ChannelCacheCount", &c.ChannelCacheCount, 100, 1, math.MaxInt)
+	if c.OverflowPolicy > SAMPLE {
+		k.problem("OverflowPolicy", c.OverflowPolicy, "unknown overflow policy")
+	}
+	k.checkInt("OverflowSampleRate", &c.OverflowSampleRate, 10, 1, math.MaxInt)
+	if c.CollectorShards < 0 {
+		// Sharding is opt-in, an invalid value leaves it off
+		if k.strict {
+			k.problem("CollectorShards", c.CollectorShards, "must not be negative")
+		} else {
+			c.CollectorShards = 0
+			k.applied("CollectorShards", c.CollectorShards)
+		}
+	} else if c.CollectorShards != 0 {
+		k.checkInt("CollectorShards", &c.CollectorShards, runtime.GOMAXPROCS(0), 1, 1024)
+	}
+	if c.MaxNames < 0 {
+		k.problem("MaxNames", c.MaxNames, "must not be negative")
+	}
+	if c.MaxEntries < 0 {
+		k.problem("MaxEntries", c.MaxEntries, "must not be negative")
+	}
+	if c.EvictAfterCycles < 0 {
+		k.problem("EvictAfterCycles", c.EvictAfterCycles, "must not be negative")
+	}
+	if c.AllowedLateness < 0 {
+		k.problem("AllowedLateness", c.AllowedLateness, "must not be negative")
+	}
+	if (c.MaxNames > 0 || c.MaxEntries > 0) && c.OtherName == "" {
+		c.OtherName = "other"
+		k.applied("OtherName", c.OtherName)
+	}
+	k.checkUint32("DefaultFastTime", &c.DefaultFastTime, defaultEntryConfig.FastLessThan)
+	if c.DefaultFailDistributionFormat == "" {
+		c.DefaultFailDistributionFormat = "code[%code]"
+		k.applied("DefaultFailDistributionFormat", c.DefaultFailDistributionFormat)
+	} else if !strings.Contains(c.DefaultFailDistributionFormat, "%code") {
+		// Register always accepted it, every failure code is then output under the same name
+		k.questionable("DefaultFailDistributionFormat", c.DefaultFailDistributionFormat, "must contain the %code placeholder")
+	}
+	// If no custom code feature recognition function is
+	//specified and the status code mapping is empty, then the default mechanism is enabled
+	if c.GetCodeFeature == nil && c.CodeFeatureMap == nil {
+		c.CodeFeatureMap = map[int]CodeFeature{
+			200: {
+				Success: true,
+			},
+		}
+		k.applied("CodeFeatureMap", c.CodeFeatureMap)
+	}
+	if c.CodeFeatureMap != nil {
+		// The synthetic CODE_* codes get their names, a copy keeps the map of the caller untouched
+		codeFeatureMap := make(map[int]CodeFeature, len(c.CodeFeatureMap)+len(syntheticCodeFeatures))
+		for code, feature := range syntheticCodeFeatures {
+			codeFeatureMap[code] = feature
+		}
+		for code, feature := range c.CodeFeatureMap {
+			codeFeatureMap[code] = feature
+		}
+		c.CodeFeatureMap = codeFeatureMap
+	}
+	if c.AlertSeverity == nil {
+		c.AlertSeverity = map[AlertType]string{
+			FAIL: "critical",
+			SLOW: "warning",
+		}
+		k.applied("AlertSeverity", c.AlertSeverity)
+	}
+	c.normalizeAlertRules(k)
+	for i, notifier := range c.Notifiers {
+		if notifier == nil {
+			k.problem("Notifiers["+strconv.Itoa(i)+"]", notifier, "must not be nil")
+		}
+	}
+	if len(c.Notifiers) > 0 {
+		k.checkInt("NotifyQueueSize", &c.NotifyQueueSize, 256, 1, math.MaxInt)
+		k.checkInt("NotifyMaxRetries", &c.NotifyMaxRetries, 3, 0, math.MaxInt)
+		k.checkDuration("NotifyBackoff", &c.NotifyBackoff, time.Second)
+		k.checkDuration("NotifyTimeout", &c.NotifyTimeout, 10*time.Second)
+	}
+	// Every client gets its own copy of the default entry configuration
+	defaultEntry := *defaultEntryConfig
+	defaultEntry.FastLessThan = c.DefaultFastTime
+	defaultEntry.fastLessThanUs = uint64(c.DefaultFastTime) * usPerMs
+	defaultEntry.SuccessRate = c.SuccessRate
+	defaultEntry.FastRate = c.FastRate
+	defaultEntry.AlertForBadSuccessRateReachedTimes = c.AlertForBadSuccessRateReachedTimes
+	defaultEntry.AlertForBadFastRateReachedTimes = c.AlertForBadFastRateReachedTimes
+	defaultEntry.AlertForGreatSuccessRateReachedTimes = c.AlertForGreatSuccessRateReachedTimes
+	defaultEntry.AlertForGreatFastRateReachedTimes = c.AlertForGreatFastRateReachedTimes
+	c.defaultEntryConfig = &defaultEntry
+	c.entryConfigMap = map[string]EntryConfig{}
+	for name, entryConfig := range c.EntryConfigs {
+		k.entry = name
+		entryConfig.normalize(k, c.defaultEntryConfig)
+		c.entryConfigMap[name] = entryConfig
+	}
+	c.entryConfigPatterns = nil
+	for _, p := range c.EntryConfigPatterns {
+		c.putEntryConfigPattern(c.normalizePattern(p, k))
+	}
+	c.entryConfigCache = map[string]*EntryConfig{}
+	k.entry = ""
+}
+
+// Validate and complete an entry configuration, unset values are taken from the client defaults
+func (e *EntryConfig) normalize(k *configChecker, defaults *EntryConfig) {
+	e.normalizeTimeUnit(k, defaults)
+	// The default is converted to the unit of the entry, it is at least one unit
+	unitUs := uint64(e.TimeUnit / time.Microsecond)
+	k.checkUint32("FastLessThan", &e.FastLessThan, uint32(math.Max(1, math.Min(float64(defaults.fastLessThanUs/unitUs), math.MaxUint32))))
+	e.fastLessThanUs = uint64(e.FastLessThan) * unitUs
+	k.checkRate("SuccessRate", &e.SuccessRate, defaults.SuccessRate)
+	k.checkRate("FastRate", &e.FastRate, defaults.FastRate)
+	k.checkInt("AlertForBadSuccessRateReachedTimes", &e.AlertForBadSuccessRateReachedTimes, defaults.AlertForBadSuccessRateReachedTimes, 3, math.MaxInt)
+	k.checkInt("AlertForBadFastRateReachedTimes", &e.AlertForBadFastRateReachedTimes, defaults.AlertForBadFastRateReachedTimes, 3, math.MaxInt)
+	k.checkInt("AlertForGreatSuccessRateReachedTimes", &e.AlertForGreatSuccessRateReachedTimes, defaults.AlertForGreatSuccessRateReachedTimes, 3, math.MaxInt)
+	k.checkInt("AlertForGreatFastRateReachedTimes", &e.AlertForGreatFastRateReachedTimes, defaults.AlertForGreatFastRateReachedTimes, 3, math.MaxInt)
+	e.normalizePercentiles(k, defaults)
+	e.normalizeDistribution(k)
+}
+
+func (e *EntryConfig) normalizeTimeUnit(k *configChecker, defaults *EntryConfig) {
+	if e.TimeUnit == 0 {
+		e.TimeUnit = defaults.TimeUnit
+		k.applied("TimeUnit", e.TimeUnit)
+	} else if e.TimeUnit < time.Microsecond || e.TimeUnit%time.Microsecond != 0 {
+		if k.strict {
+			k.problem("TimeUnit", e.TimeUnit, "must be a whole number of microseconds")
+		}
+		// Even in strict mode, the distribution is resolved in a valid unit
+		e.TimeUnit = defaults.TimeUnit
+		k.applied("TimeUnit", e.TimeUnit)
+	}
+}
+
+func (e *EntryConfig) normalizePercentiles(k *configChecker, defaults *EntryConfig) {
+	if e.DisablePercentiles {
+		return
+	}
+	if e.PercentileAccuracy == 0 {
+		e.PercentileAccuracy = defaults.PercentileAccuracy
+		k.applied("PercentileAccuracy", e.PercentileAccuracy)
+	} else if math.IsNaN(e.PercentileAccuracy) || e.PercentileAccuracy <= 0 || e.PercentileAccuracy >= 0.5 {
+		if k.strict {
+			k.problem("PercentileAccuracy", e.PercentileAccuracy, "must be greater than 0 and less than 0.5")
+		} else {
+			e.PercentileAccuracy = defaults.PercentileAccuracy
+			k.applied("PercentileAccuracy", e.PercentileAccuracy)
+		}
+	}
+	if e.Percentiles == nil {
+		e.Percentiles = defaults.Percentiles
+		k.applied("Percentiles", e.Percentiles)
+	}
+	percentiles := make([]float64, 0, len(e.Percentiles))
+	names := make([]string, 0, len(e.Percentiles))
+	seen := map[string]float64{}
+	for _, q := range e.Percentiles {
+		if math.IsNaN(q) || q <= 0 || q >= 1 {
+			// Out-of-range quantiles are dropped in lenient mode
+			if k.strict {
+				k.problem("Percentiles", q, "a quantile must be greater than 0 and less than 1")
+			}
+			continue
+		}
+		// Names are keys of OutPutData.Percentiles, e.g. 0.999 and 0.0999 are both p999: the later one is dropped
+		name := percentileName(q)
+		if other, ok := seen[name]; ok {
+			if k.strict {
+				k.problem("Percentiles", q, "has the same output name "+name+" as "+strconv.FormatFloat(other, 'f', -1, 64))
+			}
+			continue
+		}
+		seen[name] = q
+		percentiles = append(percentiles, q)
+		names = append(names, name)
+	}
+	e.Percentiles = percentiles
+	e.percentileNames = names
+}
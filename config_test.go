@@ -0,0 +1,61 @@
+package monitor_tool
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDuplicatePercentileNames(t *testing.T) {
+	e := EntryConfig{Percentiles: []float64{0.999, 0.5, 0.0999, 0.5}}
+	k := &configChecker{strict: true}
+	e.normalize(k, defaultEntryConfig)
+	if err := k.err(); err == nil {
+		t.Fatal("duplicate percentile names were accepted")
+	}
+	e = EntryConfig{Percentiles: []float64{0.999, 0.5, 0.0999, 0.5}}
+	k = &configChecker{}
+	e.normalize(k, defaultEntryConfig)
+	if err := k.err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e.Percentiles, []float64{0.999, 0.5}) || !reflect.DeepEqual(e.percentileNames, []string{"p999", "p50"}) {
+		t.Fatalf("lenient normalization kept %v named %v", e.Percentiles, e.percentileNames)
+	}
+}
+
+func TestFailDistributionFormatWithoutCode(t *testing.T) {
+	config := ReportClientConfig{Name: "format", DefaultFailDistributionFormat: "failure", DisableDefaultOutput: true}
+	var configErr *ConfigError
+	if _, err := NewClient(config); !errors.As(err, &configErr) {
+		t.Fatalf("NewClient returned %v, want a *ConfigError", err)
+	}
+	// Register keeps accepting it as it always did
+	client := Register(config)
+	defer client.Close(context.Background())
+	for _, d := range client.AppliedDefaults() {
+		if d.Field == "DefaultFailDistributionFormat" {
+			if d.Value != "failure" || d.Reason == "" {
+				t.Fatalf("applied default %+v, want the format kept with a reason", d)
+			}
+			return
+		}
+	}
+	t.Fatalf("the format is not among the applied defaults %v", client.AppliedDefaults())
+}
+
+func TestNegativeCollectorShards(t *testing.T) {
+	config := ReportClientConfig{Name: "shards", CollectorShards: -1, DisableDefaultOutput: true}
+	if _, err := NewClient(config); err == nil {
+		t.Fatal("NewClient accepted a negative CollectorShards")
+	}
+	c, err := newClient(config, &configChecker{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(context.Background())
+	if c.CollectorShards != 0 || c.sharded != nil {
+		t.Fatalf("a negative CollectorShards gave %d shards", c.CollectorShards)
+	}
+}
@@ -0,0 +1,134 @@
+package monitor_tool
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Resolve the boundaries of the time consumption distribution according to the strategy
+func (e *EntryConfig) normalizeDistribution(k *configChecker) {
+	var bounds []uint32
+	switch e.TimeConsumingDistributionStrategy {
+	case LINEAR:
+		k.checkInt("TimeConsumingDistributionSplit", &e.TimeConsumingDistributionSplit, 10, 3, math.MaxInt)
+		if !e.checkRange(k) || e.TimeConsumingDistributionSplit < 3 {
+			return
+		}
+		// Boundaries are computed from the whole range instead of a truncated interval width,
+		//so the last regular interval always ends exactly at TimeConsumingDistributionMax
+		intervals := uint64(e.TimeConsumingDistributionSplit - 2)
+		width := uint64(e.TimeConsumingDistributionMax - e.TimeConsumingDistributionMin)
+		if width < intervals {
+			k.problem("TimeConsumingDistributionSplit", e.TimeConsumingDistributionSplit, "the elapsed time range is too narrow for this number of intervals")
+			return
+		}
+		bounds = make([]uint32, 0, intervals+1)
+		for i := uint64(0); i <= intervals; i++ {
+			bounds = append(bounds, e.TimeConsumingDistributionMin+uint32(width*i/intervals))
+		}
+	case EXPONENTIAL:
+		if !e.checkRange(k) {
+			return
+		}
+		if e.TimeConsumingDistributionFactor == 0 {
+			e.TimeConsumingDistributionFactor = 2
+			k.applied("TimeConsumingDistributionFactor", e.TimeConsumingDistributionFactor)
+		} else if math.IsNaN(e.TimeConsumingDistributionFactor) || math.IsInf(e.TimeConsumingDistributionFactor, 0) || e.TimeConsumingDistributionFactor <= 1 {
+			if k.strict {
+				k.problem("TimeConsumingDistributionFactor", e.TimeConsumingDistributionFactor, "must be greater than 1")
+				return
+			}
+			e.TimeConsumingDistributionFactor = 2
+			k.applied("TimeConsumingDistributionFactor", e.TimeConsumingDistributionFactor)
+		}
+		for bound := e.TimeConsumingDistributionMin; bound < e.TimeConsumingDistributionMax; {
+			bounds = append(bounds, bound)
+			// A factor close to 1 must still make progress after rounding
+			next := math.Round(float64(bound) * e.TimeConsumingDistributionFactor)
+			if next <= float64(bound) {
+				next = float64(bound) + 1
+			}
+			if next >= float64(e.TimeConsumingDistributionMax) {
+				break
+			}
+			bound = uint32(next)
+		}
+		bounds = append(bounds, e.TimeConsumingDistributionMax)
+	case EXPLICIT:
+		if len(e.TimeConsumingDistributionBounds) == 0 {
+			k.problem("TimeConsumingDistributionBounds", e.TimeConsumingDistributionBounds, "at least one boundary is required")
+			return
+		}
+		bounds = append([]uint32(nil), e.TimeConsumingDistributionBounds...)
+		if !strictlyIncreasing(bounds) {
+			if k.strict {
+				k.problem("TimeConsumingDistributionBounds", e.TimeConsumingDistributionBounds, "boundaries must be strictly increasing")
+				return
+			}
+			sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+			bounds = uniqueBounds(bounds)
+		}
+	default:
+		k.problem("TimeConsumingDistributionStrategy", e.TimeConsumingDistributionStrategy, "unknown bucket strategy")
+		return
+	}
+	unitUs := uint64(e.TimeUnit / time.Microsecond)
+	e.boundsUs = make([]uint64, len(bounds))
+	for i, bound := range bounds {
+		e.boundsUs[i] = uint64(bound) * unitUs
+	}
+	e.bucketLabels = bucketLabels(bounds)
+}
+
+func (e *EntryConfig) checkRange(k *configChecker) bool {
+	k.checkUint32("TimeConsumingDistributionMax", &e.TimeConsumingDistributionMax, 500)
+	k.checkUint32("TimeConsumingDistributionMin", &e.TimeConsumingDistributionMin, 50)
+	if e.TimeConsumingDistributionMax <= e.TimeConsumingDistributionMin {
+		k.problem("TimeConsumingDistributionMax", e.TimeConsumingDistributionMax, "the maximum elapsed time must be greater than the minimum elapsed time")
+		return false
+	}
+	return true
+}
+
+// Index of the interval an elapsed time in microseconds falls into: the first boundary not less than the value,
+// the same as the le buckets of the Prometheus histogram
+func (e *EntryConfig) bucketIndex(us uint64) int {
+	return sort.Search(len(e.boundsUs), func(i int) bool {
+		return e.boundsUs[i] >= us
+	})
+}
+
+func strictlyIncreasing(bounds []uint32) bool {
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] <= bounds[i-1] {
+			return false
+		}
+	}
+	return true
+}
+
+func uniqueBounds(bounds []uint32) []uint32 {
+	unique := bounds[:1]
+	for _, bound := range bounds[1:] {
+		if bound != unique[len(unique)-1] {
+			unique = append(unique, bound)
+		}
+	}
+	return unique
+}
+
+// Labels "start~end" of every interval, zero padded to the width of the last boundary so that
+// sorting them as strings keeps the order of the intervals: 000~100, 100~150, ..., 500~+Inf
+func bucketLabels(bounds []uint32) []string {
+	width := len(strconv.FormatUint(uint64(bounds[len(bounds)-1]), 10))
+	labels := make([]string, 0, len(bounds)+1)
+	var start uint32
+	for _, bound := range bounds {
+		labels = append(labels, fmt.Sprintf("%0*d~%0*d", width, start, width, bound))
+		start = bound
+	}
+	return append(labels, fmt.Sprintf("%0*d~+Inf", width, start))
+}
@@ -0,0 +1,156 @@
+package monitor_tool
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucketIndexIncludesBound(t *testing.T) {
+	e := EntryConfig{TimeConsumingDistributionStrategy: EXPLICIT, TimeConsumingDistributionBounds: []uint32{10, 100}}
+	k := &configChecker{strict: true}
+	e.normalize(k, defaultEntryConfig)
+	if err := k.err(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		us   uint64
+		want int
+	}{
+		{0, 0},
+		{10 * usPerMs, 0},
+		{10*usPerMs + 1, 1},
+		{100 * usPerMs, 1},
+		{100*usPerMs + 1, 2},
+	} {
+		if got := e.bucketIndex(c.us); got != c.want {
+			t.Errorf("bucketIndex(%dus) = %d, want %d", c.us, got, c.want)
+		}
+	}
+}
+
+func TestPrometheusBucketCountsBound(t *testing.T) {
+	c, err := NewClient(ReportClientConfig{
+		Name:                 "buckets",
+		StatisticalCycle:     10,
+		DisableDefaultOutput: true,
+		EntryConfigs: map[string]EntryConfig{
+			"entry": {TimeConsumingDistributionStrategy: EXPLICIT, TimeConsumingDistributionBounds: []uint32{10, 100}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Report("entry", 10, 200)
+	c.Report("entry", 100, 200)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	handler := NewPrometheusHandler(c)
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(recorder.Body)
+	for _, sample := range []string{`le="10"} 1`, `le="100"} 2`} {
+		if !strings.Contains(string(body), sample) {
+			t.Errorf("no %s sample in\n%s", sample, body)
+		}
+	}
+}
+
+func TestExponentialBounds(t *testing.T) {
+	for _, c := range []struct {
+		min, max uint32
+		factor   float64
+		want     []string
+	}{
+		{10, 100, 2, []string{"000~010", "010~020", "020~040", "040~080", "080~100", "100~+Inf"}},
+		// The maximum is not repeated when the factor reaches it
+		{10, 80, 2, []string{"00~10", "10~20", "20~40", "40~80", "80~+Inf"}},
+		{1, 10, 3, []string{"00~01", "01~03", "03~09", "09~10", "10~+Inf"}},
+		// A factor close to 1 still makes progress after rounding
+		{10, 14, 1.01, []string{"00~10", "10~11", "11~12", "12~13", "13~14", "14~+Inf"}},
+		// The default factor is 2
+		{25, 100, 0, []string{"000~025", "025~050", "050~100", "100~+Inf"}},
+	} {
+		e := EntryConfig{
+			TimeConsumingDistributionStrategy: EXPONENTIAL,
+			TimeConsumingDistributionMin:      c.min,
+			TimeConsumingDistributionMax:      c.max,
+			TimeConsumingDistributionFactor:   c.factor,
+		}
+		k := &configChecker{strict: true}
+		e.normalize(k, defaultEntryConfig)
+		if err := k.err(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(e.bucketLabels, c.want) {
+			t.Errorf("%d~%d by %v: labels %v, want %v", c.min, c.max, c.factor, e.bucketLabels, c.want)
+		}
+		if len(e.boundsUs) != len(c.want)-1 || e.boundsUs[len(e.boundsUs)-1] != uint64(c.max)*usPerMs {
+			t.Errorf("%d~%d by %v: bounds %v", c.min, c.max, c.factor, e.boundsUs)
+		}
+	}
+}
+
+func TestExponentialFactorMustGrow(t *testing.T) {
+	e := EntryConfig{TimeConsumingDistributionStrategy: EXPONENTIAL, TimeConsumingDistributionFactor: 1}
+	k := &configChecker{strict: true}
+	e.normalize(k, defaultEntryConfig)
+	if k.err() == nil {
+		t.Fatal("a factor of 1 was accepted")
+	}
+	e = EntryConfig{TimeConsumingDistributionStrategy: EXPONENTIAL, TimeConsumingDistributionFactor: 1}
+	k = &configChecker{}
+	e.normalize(k, defaultEntryConfig)
+	if err := k.err(); err != nil || e.TimeConsumingDistributionFactor != 2 {
+		t.Fatalf("lenient normalization gave the factor %v (%v), want 2", e.TimeConsumingDistributionFactor, err)
+	}
+}
+
+func TestLinearBoundaries(t *testing.T) {
+	for _, c := range []struct {
+		min, max uint32
+		split    int
+		want     []string
+	}{
+		{100, 500, 10, []string{"000~100", "100~150", "150~200", "200~250", "250~300", "300~350", "350~400", "400~450", "450~500", "500~+Inf"}},
+		// Boundaries are spread over the whole range, the last regular interval ends at the maximum
+		{10, 20, 5, []string{"00~10", "10~13", "13~16", "16~20", "20~+Inf"}},
+		{10, 20, 3, []string{"00~10", "10~20", "20~+Inf"}},
+	} {
+		e := EntryConfig{
+			TimeConsumingDistributionMin:   c.min,
+			TimeConsumingDistributionMax:   c.max,
+			TimeConsumingDistributionSplit: c.split,
+		}
+		k := &configChecker{strict: true}
+		e.normalize(k, defaultEntryConfig)
+		if err := k.err(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(e.bucketLabels, c.want) {
+			t.Errorf("%d~%d in %d: labels %v, want %v", c.min, c.max, c.split, e.bucketLabels, c.want)
+		}
+		// Every boundary belongs to the interval it ends
+		for i, bound := range e.boundsUs {
+			if got := e.bucketIndex(bound); got != i {
+				t.Errorf("%d~%d in %d: %dus is in the interval %d, want %d", c.min, c.max, c.split, bound, got, i)
+			}
+			if got := e.bucketIndex(bound + 1); got != i+1 {
+				t.Errorf("%d~%d in %d: %dus is in the interval %d, want %d", c.min, c.max, c.split, bound+1, got, i+1)
+			}
+		}
+	}
+	e := EntryConfig{TimeConsumingDistributionMin: 10, TimeConsumingDistributionMax: 11, TimeConsumingDistributionSplit: 5}
+	k := &configChecker{strict: true}
+	e.normalize(k, defaultEntryConfig)
+	if k.err() == nil {
+		t.Fatal("3 intervals were accepted in a range of 1")
+	}
+}
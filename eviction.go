@@ -0,0 +1,92 @@
+package monitor_tool
+
+import "time"
+
+// EvictionEvent An entry that was forgotten after ReportClientConfig.EvictAfterCycles cycles without any
+// report. Its alarm state and its Prometheus series are removed as well, a later report starts it afresh
+type EvictionEvent struct {
+	ClientName    string            `json:"clientName"`
+	InterfaceName string            `json:"interfaceName"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	// End of the last cycle in which the entry had reports, zero if it never had any
+	LastActive time.Time `json:"lastActive"`
+	// End of the cycle that evicted the entry
+	Time time.Time `json:"time"`
+}
+
+// Evicted Number of entries evicted for being idle since registration
+func (c *ReportClientConfig) Evicted() uint64 {
+	if c.counters == nil {
+		return 0
+	}
+	return c.counters.evicted.Load()
+}
+
+// Called by the collector, the analysis forgets the entry once it receives the evicted copy,
+// that is after the last output of the entry
+func (c *ReportClientConfig) evictEntry(curCollectData *reportData, curTime time.Time) {
+	delete(c.collectDataMap, curCollectData.Key)
+	if c.sharded != nil && curCollectData.Labels == nil {
+		c.retireShardedEntry(curCollectData.Name)
+	}
+	evictedData := *curCollectData
+	evictedData.Time = curTime
+	evictedData.evicted = true
+	c.statisticsChannel <- evictedData
+}
+
+// The evicted names that have no entry left give back their resolved configuration and their MaxNames
+// slot, a later report of the name takes them again. Called by the collector
+func (c *ReportClientConfig) releaseNames(names map[string]struct{}) {
+	for _, curCollectData := range c.collectDataMap {
+		delete(names, curCollectData.Name)
+	}
+	for _, window := range c.eventWindows {
+		for _, windowData := range window {
+			delete(names, windowData.Name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	if c.nameLimiter != nil {
+		c.nameLimiter.lock.Lock()
+		for name := range names {
+			delete(c.nameLimiter.names, name)
+		}
+		c.nameLimiter.lock.Unlock()
+	}
+	c.entryConfigLock.Lock()
+	for name := range names {
+		delete(c.entryConfigCache, name)
+	}
+	c.entryConfigLock.Unlock()
+}
+
+// Called by the statistics goroutine, which owns the alarm state
+func (c *ReportClientConfig) forgetEntry(evictedData *reportData) {
+	delete(c.alertStatusMap, evictedData.Key)
+	c.metricsLock.Lock()
+	delete(c.metricsMap, evictedData.Key)
+	delete(c.alertMetricsMap, evictedData.Key)
+	c.metricsLock.Unlock()
+	// Alert groups are internal, only the entries that were output are announced
+	if evictedData.skipOutput {
+		return
+	}
+	c.counters.evicted.Add(1)
+	if c.EvictCaller == nil {
+		return
+	}
+	event := &EvictionEvent{
+		ClientName:    c.Name,
+		InterfaceName: evictedData.Name,
+		Labels:        evictedData.Labels,
+		LastActive:    evictedData.lastActive.UTC(),
+		Time:          evictedData.Time.UTC(),
+	}
+	caller := c.EvictCaller
+	c.alertCallQueue.push(func() {
+		caller(event)
+	})
+}
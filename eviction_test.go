@@ -0,0 +1,47 @@
+package monitor_tool
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestEvictionReleasesNames(t *testing.T) {
+	c, err := newClient(ReportClientConfig{
+		Name:                 "eviction",
+		StatisticalCycle:     10,
+		MaxNames:             5,
+		EvictAfterCycles:     1,
+		DisableDefaultOutput: true,
+	}, &configChecker{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(context.Background())
+	for i := 0; i < 5; i++ {
+		if err := c.Report("a"+strconv.Itoa(i), 10, 200); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The collector releases the names after sending the evicted entries to the analysis, the configuration
+	// cache last
+	cached := func() int {
+		c.entryConfigLock.RLock()
+		defer c.entryConfigLock.RUnlock()
+		return len(c.entryConfigCache)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Evicted() < 5 || cached() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d entries evicted and %d names still in the configuration cache", c.Evicted(), cached())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		name := "b" + strconv.Itoa(i)
+		if got := c.reportName(name); got != name {
+			t.Fatalf("%s is reported as %s, the evicted names kept their MaxNames slots", name, got)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package monitor_tool
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LineFormat Text protocol written by a LineExporter
+type LineFormat uint8
+
+const (
+	// INFLUX InfluxDB line protocol, one line per output with every figure as a field
+	INFLUX LineFormat = iota
+	// GRAPHITE Graphite plaintext protocol, one "path value timestamp" line per figure
+	GRAPHITE
+)
+
+// LineExporterConfig Configuration of a LineExporter, exactly one destination must be set
+type LineExporterConfig struct {
+	Format LineFormat
+	// Any writer, e.g. a file or a buffer
+	Writer io.Writer
+	// host:port of a TCP listener (InfluxDB socket listener, Graphite carbon), dialed lazily and again after errors
+	TCPAddress string
+	// Endpoint the lines are POSTed to, e.g. http://influx:8086/api/v2/write?org=o&bucket=b&precision=ns
+	HTTPURL string
+	// Headers added to every HTTP request, e.g. Authorization
+	HTTPHeaders map[string]string
+	// Influx measurement, the default is "monitor"
+	Measurement string
+	// Graphite path prefix, the default is "monitor"
+	Prefix string
+	// Number of outputs waiting to be written, the default is 1024. When the queue is full, outputs are dropped
+	QueueSize int
+	// Attempts after the first failed write of a batch, the default is 3. A negative value disables retries
+	MaxRetries int
+	// Wait before the first retry, doubled for every following one. The default is 500ms
+	RetryBackoff time.Duration
+	// Timeout of a TCP write or an HTTP request, the default is 5s
+	Timeout time.Duration
+	// Called when a batch is abandoned after its last retry, the default writes the error to stderr
+	ErrorCaller func(err error)
+}
+
+// LineExporter Writes every OutPutData as InfluxDB line protocol or Graphite plaintext, to a writer, a TCP
+// listener or an HTTP endpoint. Its Output is meant as the OutputCaller of a client: a goroutine of the
+// exporter writes the queued outputs in batches and retries a failed batch, during an outage of the backend
+// the queue fills up and further outputs are dropped
+type LineExporter struct {
+	outputQueue
+	config LineExporterConfig
+	// Closed by Close to cut the backoff of a retry short
+	stop   chan struct{}
+	conn   net.Conn
+	client *http.Client
+	batch  bytes.Buffer
+}
+
+func NewLineExporter(config LineExporterConfig) (*LineExporter, error) {
+	destinations := 0
+	for _, set := range []bool{config.Writer != nil, config.TCPAddress != "", config.HTTPURL != ""} {
+		if set {
+			destinations++
+		}
+	}
+	if destinations != 1 {
+		return nil, errors.New("exactly one of Writer, TCPAddress and HTTPURL must be set")
+	}
+	if config.Format != INFLUX && config.Format != GRAPHITE {
+		return nil, errors.New("unknown line format " + strconv.Itoa(int(config.Format)))
+	}
+	if config.Measurement == "" {
+		config.Measurement = "monitor"
+	}
+	if config.Prefix == "" {
+		config.Prefix = "monitor"
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1024
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = 3
+	} else if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = 500 * time.Millisecond
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.ErrorCaller == nil {
+		config.ErrorCaller = func(err error) {
+			os.Stderr.WriteString("line exporter: " + err.Error() + "\n")
+		}
+	}
+	e := &LineExporter{
+		config: config,
+		stop:   make(chan struct{}),
+		client: &http.Client{Timeout: config.Timeout},
+	}
+	e.outputQueue.init(config.QueueSize)
+	go e.write()
+	return e, nil
+}
+
+// Close Write what is queued, retries are no longer waited for, and release the connection
+func (e *LineExporter) Close() error {
+	if !e.outputQueue.close() {
+		return errors.New("the line exporter has been closed")
+	}
+	close(e.stop)
+	<-e.done
+	if e.conn != nil {
+		return e.conn.Close()
+	}
+	return nil
+}
+
+func (e *LineExporter) write() {
+	defer close(e.done)
+	for o := range e.queue {
+		count := 1
+		e.batch.Reset()
+		e.encode(&o)
+		// Batch whatever else is already waiting
+		for pending := len(e.queue); pending > 0; pending-- {
+			next, ok := <-e.queue
+			if !ok {
+				break
+			}
+			e.encode(&next)
+			count++
+		}
+		e.send(count)
+	}
+}
+
+func (e *LineExporter) encode(o *OutPutData) {
+	if e.config.Format == GRAPHITE {
+		WriteGraphite(&e.batch, e.config.Prefix, o)
+	} else {
+		WriteInflux(&e.batch, e.config.Measurement, o)
+	}
+}
+
+// Write the batch, retrying with an exponential backoff. Once closing, retries are no longer waited for
+func (e *LineExporter) send(count int) {
+	backoff := e.config.RetryBackoff
+	var err error
+	for attempt := 0; attempt <= e.config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-e.stop:
+			}
+			backoff *= 2
+		}
+		if err = e.deliver(e.batch.Bytes()); err == nil {
+			return
+		}
+	}
+	e.dropped.Add(uint64(count))
+	e.config.ErrorCaller(errors.New("abandoned " + strconv.Itoa(count) + " outputs: " + err.Error()))
+}
+
+func (e *LineExporter) deliver(payload []byte) error {
+	switch {
+	case e.config.Writer != nil:
+		_, err := e.config.Writer.Write(payload)
+		return err
+	case e.config.TCPAddress != "":
+		if e.conn == nil {
+			conn, err := net.DialTimeout("tcp", e.config.TCPAddress, e.config.Timeout)
+			if err != nil {
+				return err
+			}
+			e.conn = conn
+		}
+		e.conn.SetWriteDeadline(time.Now().Add(e.config.Timeout))
+		if _, err := e.conn.Write(payload); err != nil {
+			// A partial write leaves the stream in an unknown state, start over on a new connection
+			e.conn.Close()
+			e.conn = nil
+			return err
+		}
+		return nil
+	default:
+		request, err := http.NewRequest(http.MethodPost, e.config.HTTPURL, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		for k, v := range e.config.HTTPHeaders {
+			request.Header.Set(k, v)
+		}
+		response, err := e.client.Do(request)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		if response.StatusCode/100 != 2 {
+			return errors.New("unexpected status " + response.Status)
+		}
+		return nil
+	}
+}
+
+// WriteInflux Write one output as a line of InfluxDB line protocol: the client, the interface and the labels
+// are tags, the figures are fields, every failure code and latency interval being a field of its own
+// (fail.<name>, bucket.<interval>, latency.<percentile>). The timestamp is in nanoseconds
+func WriteInflux(w io.Writer, measurement string, o *OutPutData) error {
+	var line bytes.Buffer
+	line.WriteString(influxMeasurementReplacer.Replace(measurement))
+	tags := map[string]string{"client": o.ClientName, "interface": o.InterfaceName}
+	for k, v := range o.Labels {
+		if k == "client" || k == "interface" {
+			k = "label_" + k
+		}
+		tags[k] = v
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	// Sorted tags are what InfluxDB recommends for the best write performance
+	sort.Strings(keys)
+	for _, k := range keys {
+		// Empty tag values are not allowed by the protocol
+		if tags[k] == "" {
+			continue
+		}
+		line.WriteString("," + influxKeyReplacer.Replace(k) + "=" + influxKeyReplacer.Replace(tags[k]))
+	}
+	fields := []string{
+		"count=" + strconv.FormatUint(uint64(o.Count), 10) + "i",
+		"success=" + strconv.FormatUint(uint64(o.SuccessCount), 10) + "i",
+		"fail=" + strconv.FormatUint(uint64(o.FailCount), 10) + "i",
+		"fast=" + strconv.FormatUint(uint64(o.FastCount), 10) + "i",
+		"success_rate=" + strconv.FormatFloat(o.SuccessRate, 'g', -1, 64),
+		"fast_rate=" + strconv.FormatFloat(o.FastRate, 'g', -1, 64),
+		"success_ms_aver=" + strconv.FormatUint(uint64(o.SuccessMsAver), 10) + "i",
+		"max_ms=" + strconv.FormatUint(uint64(o.MaxMs), 10) + "i",
+		"min_ms=" + strconv.FormatUint(uint64(o.MinMs), 10) + "i",
+	}
+	for _, name := range sortedKeys(o.FailDistribution) {
+		fields = append(fields, influxKeyReplacer.Replace("fail."+name)+"="+strconv.FormatUint(uint64(o.FailDistribution[name]), 10)+"i")
+	}
+	for _, name := range sortedKeys(o.TimeConsumingDistribution) {
+		fields = append(fields, influxKeyReplacer.Replace("bucket."+name)+"="+strconv.FormatUint(uint64(o.TimeConsumingDistribution[name]), 10)+"i")
+	}
+	for _, name := range sortedKeys(o.Percentiles) {
+		fields = append(fields, influxKeyReplacer.Replace("latency."+name)+"="+strconv.FormatUint(uint64(o.Percentiles[name]), 10)+"i")
+	}
+	line.WriteString(" " + strings.Join(fields, ",") + " " + strconv.FormatInt(o.Timestamp.UnixNano(), 10) + "\n")
+	_, err := w.Write(line.Bytes())
+	return err
+}
+
+// Measurements escape commas and spaces, tag keys, tag values and field keys escape equal signs as well.
+// The line protocol cannot escape line breaks, they are written as escaped spaces
+var (
+	influxMeasurementReplacer = strings.NewReplacer(`\`, `\\`, ",", `\,`, " ", `\ `, "\n", `\ `, "\r", `\ `)
+	influxKeyReplacer         = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `, "\n", `\ `, "\r", `\ `)
+)
+
+// The dots of a Graphite prefix separate its parts, only the separators of the line are replaced
+var graphitePrefixReplacer = strings.NewReplacer(" ", "_", "\t", "_", "\n", "_", "\r", "_")
+
+// WriteGraphite Write one output as Graphite plaintext, one "path value timestamp" line per figure.
+// Paths are prefix.client.interface[.label_value...].figure, with fail_by_code.<name>,
+// bucket.<interval> and latency.<percentile> series. The timestamp is in seconds
+func WriteGraphite(w io.Writer, prefix string, o *OutPutData) error {
+	var lines bytes.Buffer
+	path := graphitePrefixReplacer.Replace(prefix) + "." + metricNamePart(o.ClientName) + "." + metricNamePart(o.InterfaceName) + "."
+	for _, k := range sortedLabelKeys(o.Labels) {
+		path += metricNamePart(k) + "_" + metricNamePart(o.Labels[k]) + "."
+	}
+	timestamp := " " + strconv.FormatInt(o.Timestamp.Unix(), 10) + "\n"
+	line := func(name string, value string) {
+		lines.WriteString(path + name + " " + value + timestamp)
+	}
+	line("count", strconv.FormatUint(uint64(o.Count), 10))
+	line("success", strconv.FormatUint(uint64(o.SuccessCount), 10))
+	line("fail", strconv.FormatUint(uint64(o.FailCount), 10))
+	line("fast", strconv.FormatUint(uint64(o.FastCount), 10))
+	line("success_rate", strconv.FormatFloat(o.SuccessRate, 'f', -1, 64))
+	line("fast_rate", strconv.FormatFloat(o.FastRate, 'f', -1, 64))
+	line("success_ms_aver", strconv.FormatUint(uint64(o.SuccessMsAver), 10))
+	line("max_ms", strconv.FormatUint(uint64(o.MaxMs), 10))
+	line("min_ms", strconv.FormatUint(uint64(o.MinMs), 10))
+	for _, name := range sortedKeys(o.FailDistribution) {
+		line("fail_by_code."+metricNamePart(name), strconv.FormatUint(uint64(o.FailDistribution[name]), 10))
+	}
+	for _, name := range sortedKeys(o.TimeConsumingDistribution) {
+		line("bucket."+metricNamePart(name), strconv.FormatUint(uint64(o.TimeConsumingDistribution[name]), 10))
+	}
+	for _, name := range sortedKeys(o.Percentiles) {
+		line("latency."+metricNamePart(name), strconv.FormatUint(uint64(o.Percentiles[name]), 10))
+	}
+	_, err := w.Write(lines.Bytes())
+	return err
+}
+
+// outputQueue The bounded queue between a client and the goroutine of an exporter, embedded by
+// StatsDExporter and LineExporter. The goroutine ranges over queue and closes done once it is drained
+type outputQueue struct {
+	queue   chan OutPutData
+	done    chan struct{}
+	lock    sync.RWMutex
+	closed  bool
+	dropped atomic.Uint64
+}
+
+func (q *outputQueue) init(size int) {
+	q.queue = make(chan OutPutData, size)
+	q.done = make(chan struct{})
+}
+
+// Output Hand the data over to the exporter without waiting for it, the data is dropped when the queue
+// is full or the exporter is closed
+func (q *outputQueue) Output(o *OutPutData) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.closed {
+		q.dropped.Add(1)
+		return
+	}
+	select {
+	case q.queue <- *o:
+	default:
+		q.dropped.Add(1)
+	}
+}
+
+// Dropped Number of outputs the exporter did not send: the queue was full or the exporter closed, and for a
+// LineExporter the batches abandoned after their last retry
+func (q *outputQueue) Dropped() uint64 {
+	return q.dropped.Load()
+}
+
+// Stop taking outputs, the goroutine of the exporter still drains the queue. False when it was already closed
+func (q *outputQueue) close() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return false
+	}
+	q.closed = true
+	close(q.queue)
+	return true
+}
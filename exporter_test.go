@@ -0,0 +1,159 @@
+package monitor_tool
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInfluxLineBreaks(t *testing.T) {
+	var line bytes.Buffer
+	o := &OutPutData{
+		ClientName:    "client\nname",
+		InterfaceName: "GET /users\r\n",
+		Labels:        map[string]string{"tenant\n": "a\nb"},
+		Timestamp:     time.Unix(1, 0),
+	}
+	if err := WriteInflux(&line, "monitor\n", o); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(line.String(), "\n"); n != 1 || !strings.HasSuffix(line.String(), "\n") {
+		t.Fatalf("%d line breaks in %q, want only the final one", n, line.String())
+	}
+	if !strings.Contains(line.String(), `tenant\ =a\ b`) {
+		t.Fatalf("the line breaks of the labels were not replaced in %q", line.String())
+	}
+}
+
+func TestInfluxEscaping(t *testing.T) {
+	var line bytes.Buffer
+	o := &OutPutData{
+		ClientName:       `api,v1`,
+		InterfaceName:    "GET /users?id=1",
+		Labels:           map[string]string{"client": "web", "path\\": `C:\`, "empty": ""},
+		Count:            2,
+		FailCount:        1,
+		FailDistribution: map[string]uint32{"code 500": 1},
+		Timestamp:        time.Unix(1, 5),
+	}
+	if err := WriteInflux(&line, "my monitor,app", o); err != nil {
+		t.Fatal(err)
+	}
+	want := `my\ monitor\,app,client=api\,v1,interface=GET\ /users?id\=1,label_client=web,path\\=C:\\ ` +
+		"count=2i,success=0i,fail=1i,fast=0i,success_rate=0,fast_rate=0,success_ms_aver=0i,max_ms=0i,min_ms=0i," +
+		`fail.code\ 500=1i 1000000005` + "\n"
+	if line.String() != want {
+		t.Fatalf("line\n%q\nwant\n%q", line.String(), want)
+	}
+}
+
+func TestGraphitePaths(t *testing.T) {
+	var lines bytes.Buffer
+	o := &OutPutData{
+		ClientName:       "api v1",
+		InterfaceName:    "GET /users\n",
+		Labels:           map[string]string{"zone": "eu\r\n1"},
+		Count:            2,
+		FailDistribution: map[string]uint32{"503 Service Unavailable": 1},
+		Percentiles:      map[string]uint32{"p99": 7},
+		Timestamp:        time.Unix(60, 0),
+	}
+	if err := WriteGraphite(&lines, "app.web\n", o); err != nil {
+		t.Fatal(err)
+	}
+	path := "app.web_.api_v1.GET__users_.zone_eu__1."
+	got := strings.Split(strings.TrimSuffix(lines.String(), "\n"), "\n")
+	if len(got) != 11 {
+		t.Fatalf("%d lines, want 11:\n%s", len(got), lines.String())
+	}
+	for _, line := range got {
+		if parts := strings.Split(line, " "); len(parts) != 3 || !strings.HasPrefix(parts[0], path) || parts[2] != "60" {
+			t.Fatalf("line %q, want %s<figure> <value> 60", line, path)
+		}
+	}
+	if got[0] != path+"count 2 60" || got[9] != path+"fail_by_code.503_Service_Unavailable 1 60" || got[10] != path+"latency.p99 7 60" {
+		t.Fatalf("lines\n%s", lines.String())
+	}
+}
+
+type failingWriter struct {
+	writes atomic.Int32
+}
+
+func (w *failingWriter) Write([]byte) (int, error) {
+	w.writes.Add(1)
+	return 0, errors.New("unavailable")
+}
+
+func TestLineExporterWithoutRetries(t *testing.T) {
+	w := &failingWriter{}
+	abandoned := make(chan error, 1)
+	e, err := NewLineExporter(LineExporterConfig{
+		Writer:       w,
+		MaxRetries:   -1,
+		RetryBackoff: time.Hour,
+		ErrorCaller:  func(err error) { abandoned <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Output(&OutPutData{ClientName: "client", InterfaceName: "entry", Timestamp: time.Unix(1, 0)})
+	select {
+	case <-abandoned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the batch was not abandoned after its only attempt")
+	}
+	e.Close()
+	if n := w.writes.Load(); n != 1 {
+		t.Fatalf("%d writes, want 1", n)
+	}
+	if e.Dropped() != 1 {
+		t.Fatalf("%d outputs dropped, want 1", e.Dropped())
+	}
+}
+
+// Fails the first writes, then succeeds
+type flakyWriter struct {
+	failures int32
+	writes   atomic.Int32
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	if w.writes.Add(1) <= w.failures {
+		return 0, errors.New("unavailable")
+	}
+	return len(p), nil
+}
+
+func TestLineExporterRetries(t *testing.T) {
+	w := &flakyWriter{failures: 2}
+	e, err := NewLineExporter(LineExporterConfig{
+		Writer:       w,
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+		ErrorCaller:  func(err error) { t.Errorf("the batch was abandoned: %v", err) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Output(&OutPutData{ClientName: "client", InterfaceName: "entry", Timestamp: time.Unix(1, 0)})
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := w.writes.Load(); n != 3 {
+		t.Fatalf("%d writes, want 3", n)
+	}
+	if e.Dropped() != 0 {
+		t.Fatalf("%d outputs dropped, want 0", e.Dropped())
+	}
+	if err := e.Close(); err == nil {
+		t.Fatal("a second Close succeeded")
+	}
+	e.Output(&OutPutData{})
+	if e.Dropped() != 1 {
+		t.Fatalf("%d outputs dropped after Close, want 1", e.Dropped())
+	}
+}
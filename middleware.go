@@ -0,0 +1,228 @@
+package monitor_tool
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MiddlewareConfig Configuration of NewMiddleware
+type MiddlewareConfig struct {
+	// Route of a request, the entry is named by the method followed by the route, e.g. "GET /users/{id}".
+	// The default is ServeMuxRoute when the wrapped handler is a *http.ServeMux, the URL path otherwise
+	//(combine it with a NameNormalizer such as PathNormalizer to keep ids out of the names)
+	Route func(r *http.Request) string
+	// Labels of the report of a request, nil reports without labels
+	Labels func(r *http.Request) map[string]string
+	// Answer 500 to a request whose handler panicked and carry on, instead of reporting the 500 and
+	//panicking again for net/http to log the panic and abort the response
+	RecoverPanics bool
+}
+
+// NewMiddleware Wraps an http.Handler to report every request to the client, with the status code
+// written by the handler (200 when it writes none) and the time until the handler returned.
+// Use HTTPCodeFeature as GetCodeFeature of the client to count 2xx and 3xx as successes
+func NewMiddleware(client ReportClient, config MiddlewareConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		route := config.Route
+		if route == nil {
+			if mux, ok := next.(*http.ServeMux); ok {
+				route = ServeMuxRoute(mux)
+			} else {
+				route = func(r *http.Request) string { return r.URL.Path }
+			}
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w}
+			defer func() {
+				recovered := recover()
+				code := recorder.code()
+				if recovered != nil {
+					code = http.StatusInternalServerError
+				}
+				name := r.Method + " " + route(r)
+				elapsed := time.Since(start)
+				if config.Labels != nil {
+					client.ReportDurationWithLabels(name, config.Labels(r), elapsed, code)
+				} else {
+					client.ReportDuration(name, elapsed, code)
+				}
+				if recovered == nil {
+					return
+				}
+				if !config.RecoverPanics || recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+				if !recorder.wroteHeader {
+					http.Error(recorder, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				}
+			}()
+			next.ServeHTTP(recorder.writer(), r)
+		})
+	}
+}
+
+// ServeMuxRoute The pattern of the mux that handles a request, without the method and the host it may
+// contain: "/users/{id}" for a request routed by the pattern "GET /users/{id}". Requests that match no
+// pattern are named "{unmatched}", so that scanners do not create an entry per URL
+func ServeMuxRoute(mux *http.ServeMux) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			return "{unmatched}"
+		}
+		// [METHOD ][HOST]/[PATH]
+		if i := strings.IndexByte(pattern, ' '); i >= 0 {
+			pattern = strings.TrimLeft(pattern[i+1:], " \t")
+		}
+		if i := strings.IndexByte(pattern, '/'); i > 0 {
+			pattern = pattern[i:]
+		}
+		return pattern
+	}
+}
+
+// HTTPCodeFeature A ReportClientConfig.GetCodeFeature for HTTP status codes: 1xx, 2xx and 3xx are successes,
+// failures are named by their code and status text, e.g. "503 Service Unavailable", and the synthetic
+// CODE_* codes by their name
+func HTTPCodeFeature(code int) (success bool, name string) {
+	if feature, ok := syntheticCodeFeatures[code]; ok {
+		return false, feature.Name
+	}
+	if code < 400 {
+		return code > 0, ""
+	}
+	if text := http.StatusText(code); text != "" {
+		return false, strconv.Itoa(code) + " " + text
+	}
+	return false, strconv.Itoa(code)
+}
+
+// statusRecorder Keeps the status code written through the ResponseWriter. The handler gets it from writer,
+// with only the optional interfaces of the wrapped writer among http.Flusher, http.Hijacker and
+// io.ReaderFrom, and it unwraps for http.ResponseController
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	hijacked    bool
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	// Informational responses may precede the final status
+	if !w.wroteHeader && code >= 200 {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	w.implicitHeader()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Writing the body or flushing without a status sends 200
+func (w *statusRecorder) implicitHeader() {
+	if !w.wroteHeader {
+		w.status = http.StatusOK
+		w.wroteHeader = true
+	}
+}
+
+type recorderFlusher struct{ *statusRecorder }
+
+func (w recorderFlusher) Flush() {
+	w.implicitHeader()
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+type recorderHijacker struct{ *statusRecorder }
+
+func (w recorderHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Keeps the sendfile and splice optimizations of the net/http response
+type recorderReaderFrom struct{ *statusRecorder }
+
+func (w recorderReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	w.implicitHeader()
+	return w.ResponseWriter.(io.ReaderFrom).ReadFrom(r)
+}
+
+// The recorder with the optional interfaces of the wrapped writer, a handler that checks for one of them
+// behaves the same as without the middleware
+func (w *statusRecorder) writer() http.ResponseWriter {
+	_, canFlush := w.ResponseWriter.(http.Flusher)
+	_, canHijack := w.ResponseWriter.(http.Hijacker)
+	_, canReadFrom := w.ResponseWriter.(io.ReaderFrom)
+	flusher, hijacker, readerFrom := recorderFlusher{w}, recorderHijacker{w}, recorderReaderFrom{w}
+	switch {
+	case canFlush && canHijack && canReadFrom:
+		return struct {
+			*statusRecorder
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{w, flusher, hijacker, readerFrom}
+	case canFlush && canHijack:
+		return struct {
+			*statusRecorder
+			http.Flusher
+			http.Hijacker
+		}{w, flusher, hijacker}
+	case canFlush && canReadFrom:
+		return struct {
+			*statusRecorder
+			http.Flusher
+			io.ReaderFrom
+		}{w, flusher, readerFrom}
+	case canHijack && canReadFrom:
+		return struct {
+			*statusRecorder
+			http.Hijacker
+			io.ReaderFrom
+		}{w, hijacker, readerFrom}
+	case canFlush:
+		return struct {
+			*statusRecorder
+			http.Flusher
+		}{w, flusher}
+	case canHijack:
+		return struct {
+			*statusRecorder
+			http.Hijacker
+		}{w, hijacker}
+	case canReadFrom:
+		return struct {
+			*statusRecorder
+			io.ReaderFrom
+		}{w, readerFrom}
+	}
+	return w
+}
+
+// The status of the response, 101 for a hijacked connection without any status written
+func (w *statusRecorder) code() int {
+	if w.wroteHeader {
+		return w.status
+	}
+	if w.hijacked {
+		return http.StatusSwitchingProtocols
+	}
+	return http.StatusOK
+}
@@ -0,0 +1,156 @@
+package monitor_tool
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serve the handler through the middleware, done is signaled once the middleware has reported
+func middlewareServer(t *testing.T, client ReportClient, config MiddlewareConfig, handler http.Handler) (*httptest.Server, chan struct{}) {
+	t.Helper()
+	done := make(chan struct{}, 1)
+	wrapped := NewMiddleware(client, config)(handler)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() { done <- struct{}{} }()
+		wrapped.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, done
+}
+
+func TestMiddlewareReportsTheStatus(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		handler http.HandlerFunc
+		code    int
+	}{
+		{"nothing written", func(w http.ResponseWriter, r *http.Request) {}, 200},
+		{"status", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(404) }, 404},
+		{"body", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("body")) }, 200},
+		{"status after the body", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("body"))
+			w.WriteHeader(500)
+		}, 200},
+		{"informational status", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(103)
+			w.WriteHeader(204)
+		}, 204},
+		{"flush", func(w http.ResponseWriter, r *http.Request) { w.(http.Flusher).Flush() }, 200},
+		{"read from", func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(w, strings.NewReader("body"))
+		}, 200},
+		{"panic", func(w http.ResponseWriter, r *http.Request) { panic("handler") }, 500},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			client := &sqlRecordingClient{}
+			w := httptest.NewRecorder()
+			NewMiddleware(client, MiddlewareConfig{RecoverPanics: true})(c.handler).ServeHTTP(w, httptest.NewRequest("GET", "/users/42", nil))
+			expectReports(t, client, sqlTestReport{name: "GET /users/42", code: c.code})
+			if c.code == 500 && w.Code != 500 {
+				t.Fatalf("the recovered panic answered %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestMiddlewareNamesServeMuxRoutes(t *testing.T) {
+	client := &sqlRecordingClient{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	handler := NewMiddleware(client, MiddlewareConfig{
+		Labels: func(r *http.Request) map[string]string { return map[string]string{"host": r.Host} },
+	})(mux)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/users/42", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/.env", nil))
+	expectReports(t, client,
+		sqlTestReport{name: "GET /users/{id}", labels: map[string]string{"host": "example.com"}, code: 200},
+		sqlTestReport{name: "GET {unmatched}", labels: map[string]string{"host": "example.com"}, code: 404},
+	)
+}
+
+// A ResponseWriter without any optional interface
+type plainResponseWriter struct {
+	header http.Header
+}
+
+func (w *plainResponseWriter) Header() http.Header         { return w.header }
+func (w *plainResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *plainResponseWriter) WriteHeader(int)             {}
+
+func TestMiddlewareKeepsTheInterfacesOfTheWriter(t *testing.T) {
+	interfaces := func(w http.ResponseWriter) [3]bool {
+		_, flusher := w.(http.Flusher)
+		_, hijacker := w.(http.Hijacker)
+		_, readerFrom := w.(io.ReaderFrom)
+		return [3]bool{flusher, hijacker, readerFrom}
+	}
+	var got [3]bool
+	handler := NewMiddleware(&sqlRecordingClient{}, MiddlewareConfig{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = interfaces(w)
+	}))
+	for _, w := range []http.ResponseWriter{&plainResponseWriter{header: http.Header{}}, httptest.NewRecorder()} {
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if want := interfaces(w); got != want {
+			t.Fatalf("the handler of a %T sees the interfaces %v, want %v", w, got, want)
+		}
+	}
+	// The net/http response has all of them
+	server, done := middlewareServer(t, &sqlRecordingClient{}, MiddlewareConfig{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = interfaces(w)
+	}))
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	<-done
+	if got != [3]bool{true, true, true} {
+		t.Fatalf("the handler of a net/http response sees the interfaces %v", got)
+	}
+}
+
+func TestMiddlewareResponseController(t *testing.T) {
+	client := &sqlRecordingClient{}
+	server, done := middlewareServer(t, client, MiddlewareConfig{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(time.Now().Add(time.Minute)); err != nil {
+			t.Errorf("SetWriteDeadline: %v", err)
+		}
+		w.WriteHeader(202)
+		if err := rc.Flush(); err != nil {
+			t.Errorf("Flush: %v", err)
+		}
+	}))
+	response, err := http.Get(server.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	<-done
+	expectReports(t, client, sqlTestReport{name: "GET /stream", code: 202})
+}
+
+func TestMiddlewareHijackedConnection(t *testing.T) {
+	client := &sqlRecordingClient{}
+	server, done := middlewareServer(t, client, MiddlewareConfig{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		rw.Flush()
+	}))
+	response, err := http.Get(server.URL + "/socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	<-done
+	expectReports(t, client, sqlTestReport{name: "GET /socket", code: 101})
+}
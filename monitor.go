@@ -1,8 +1,15 @@
 package monitor_tool
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type (
@@ -10,6 +17,10 @@ type (
 	AlertType uint8
 	// TaskType Queue task type enumeration
 	TaskType uint8
+	// OverflowPolicy What Report does when the task channel is full
+	OverflowPolicy uint8
+	// BucketStrategy How the boundaries of the time consumption distribution are laid out
+	BucketStrategy uint8
 )
 
 const (
@@ -18,19 +29,108 @@ const (
 	// FAIL Access Success Rate Alerts
 	FAIL
 	SLOW
+	// RULE Default type of the custom AlertRules
+	RULE
 )
 
+func (t AlertType) String() string {
+	switch t {
+	case NONE:
+		return "NONE"
+	case FAIL:
+		return "FAIL"
+	case SLOW:
+		return "SLOW"
+	case RULE:
+		return "RULE"
+	}
+	return "AlertType(" + strconv.Itoa(int(t)) + ")"
+}
+
 const (
 	_ TaskType = iota
 	SERVER
 	CLEAR
+	// BATCH A batch of pre-aggregated reports, see ReportBatch
+	BATCH
+)
+
+const (
+	// BLOCK Wait until the collector makes room, nothing is lost but reporting may stall
+	BLOCK OverflowPolicy = iota
+	// DROP_NEWEST Drop the report being made
+	DROP_NEWEST
+	// DROP_OLDEST Drop the report that has been waiting the longest to make room for the new one
+	DROP_OLDEST
+	// SAMPLE Once the channel is half full (or holds a task, for a channel of one), only let one report out
+	//of OverflowSampleRate through, and drop when it is full
+	SAMPLE
+)
+
+const (
+	// LINEAR Equal intervals between TimeConsumingDistributionMin and TimeConsumingDistributionMax
+	LINEAR BucketStrategy = iota
+	// EXPONENTIAL Boundaries start at TimeConsumingDistributionMin and grow by TimeConsumingDistributionFactor
+	//up to TimeConsumingDistributionMax
+	EXPONENTIAL
+	// EXPLICIT Boundaries listed in TimeConsumingDistributionBounds
+	EXPLICIT
+)
+
+var (
+	// ErrNotRegistered Returned when reporting through a client that was not obtained from Register
+	ErrNotRegistered = errors.New("please first register this report type")
+	// ErrClientClosed Returned when reporting through a client that has already been closed
+	ErrClientClosed = errors.New("the report client has been closed")
+	// ErrReportDropped Returned when the overflow policy dropped the report
+	ErrReportDropped = errors.New("the report was dropped, the task channel is full")
+	// ErrReportLate Returned by ReportAt when the window of the event has already been output
+	ErrReportLate = errors.New("the report was dropped, its window is past the allowed lateness")
 )
 
 type ReportClient interface {
-	Report(name string, ms uint32, code int)
+	Report(name string, ms uint32, code int) error
+	// ReportWithLabels Report with dimensional labels, every label set is a series of its own
+	ReportWithLabels(name string, labels map[string]string, ms uint32, code int) error
+	// TryReport Report without ever blocking, false when the report was dropped or the client closed
+	TryReport(name string, ms uint32, code int) bool
+	// ReportDuration Same as Report with a time.Duration, kept to the microsecond
+	ReportDuration(name string, d time.Duration, code int) error
+	// ReportDurationWithLabels Same as ReportWithLabels with a time.Duration, kept to the microsecond
+	ReportDurationWithLabels(name string, labels map[string]string, d time.Duration, code int) error
+	// ReportAt Report an event in the window of its own time rather than in the cycle open when it is collected
+	ReportAt(name string, ts time.Time, ms uint32, code int) error
+	// Late Number of ReportAt events dropped for arriving after the allowed lateness since registration
+	Late() uint64
+	// ReportBatch Merge calls already aggregated by the source, the batch is a single task
+	ReportBatch(reports []AggregatedReport) error
+	// ReportAggregated ReportBatch of the calls of a single name and code
+	ReportAggregated(name string, code int, count uint32, sumMs uint64, minMs uint32, maxMs uint32, histogram map[uint32]uint32) error
+	// Dropped Number of reports dropped by the overflow policy since registration
+	Dropped() uint64
+	// Evicted Number of entries evicted for being idle since registration, see EvictAfterCycles
+	Evicted() uint64
+	// Track Start timing an operation, the returned function reports it with its code
+	Track(name string) func(code int)
+	// Observe Run and report an operation, its error is turned into a code by ErrorClassifier
+	Observe(name string, operation func() error) error
 	// AddEntryConfig Add custom entry configuration, including data such as time consumption
 	//criteria and latency distribution for the entry
 	AddEntryConfig(name string, entryConfig EntryConfig)
+	// SetEntryConfig Same as AddEntryConfig, but invalid values are returned as a *ConfigError
+	//instead of being replaced by defaults or causing a panic
+	SetEntryConfig(name string, entryConfig EntryConfig) error
+	// AddEntryConfigPattern Add an entry configuration for every name matching a pattern, see EntryConfigPattern
+	AddEntryConfigPattern(kind MatchKind, pattern string, entryConfig EntryConfig)
+	// SetEntryConfigPattern Same as AddEntryConfigPattern, but errors are returned as a *ConfigError
+	SetEntryConfigPattern(kind MatchKind, pattern string, entryConfig EntryConfig) error
+	// AppliedDefaults The defaults that were filled in while the client and its EntryConfigs were validated
+	AppliedDefaults() []AppliedDefault
+	// Close Stop the client: the ticker is stopped, reports already queued are drained, every entry
+	//is flushed as a final statistical cycle and pending OutputCaller/AlertCaller calls are awaited.
+	// Once Close has been called, Report returns ErrClientClosed, as does a BLOCK report still waiting for
+	//room. If ctx ends first, its error is returned and the shutdown keeps going in the background
+	Close(ctx context.Context) error
 }
 
 // ReportClientConfig Global configuration of the client, a client may report several interfaces
@@ -52,15 +152,113 @@ type ReportClientConfig struct {
 	AlertCaller                          func(clientName string, interfaceName string, alertType AlertType, recentOutputData []OutPutData)
 	// Recovery notification handling customization, same as AlertCaller
 	RecoverCaller func(clientName string, interfaceName string, alertType AlertType, recentOutputData []OutPutData)
+	// Alarm and recovery handling customization that tells the rules apart: the custom rules all come to
+	// AlertCaller and RecoverCaller as RULE unless they have their own Type, the event has the name and the
+	// labels of the rule. Called from the same goroutine as AlertCaller, the event must not be modified
+	AlertEventCaller func(event *AlertEvent)
+	// What Report does when the task channel (of ChannelCacheCount tasks) is full, the default is BLOCK
+	OverflowPolicy OverflowPolicy
+	// SAMPLE only: one report out of this many is kept under pressure, the default is 10
+	OverflowSampleRate int
+	// Report and TryReport count into this many lock-free shards per entry instead of going through the task
+	// channel, the collector merges the shards when it closes the cycle. Meant for hundreds of thousands of
+	// reports per second. Every entry has its shards, a shard allocates its sketch counters 512 bytes at a time
+	// for the elapsed times it sees: usually 1 or 2KB, at most about 11.6KB at the default percentile accuracy.
+	// ReportWithLabels, and failures beyond 8 distinct codes per shard, still go through the task channel.
+	// 0, the default, disables sharding; runtime.GOMAXPROCS(0) is a good start
+	CollectorShards int
+	// Notifiers receive every alarm and recovery as an AlertEvent. Each one has a bounded queue and a delivery
+	// goroutine of its own, retrying with an exponential backoff: the alarm analysis only queues the events
+	Notifiers []Notifier
+	// Severity given to the events of each alarm type, the default is critical for FAIL and warning for SLOW
+	AlertSeverity map[AlertType]string
+	// Custom alarm conditions, analyzed after the built-in FAIL and SLOW rules, see AlertRule
+	AlertRules []AlertRule
+	// Only analyze AlertRules, without the built-in FAIL and SLOW rules
+	DisableDefaultAlertRules bool
+	// Events waiting per notifier, the default is 256. When a queue is full, events go to the dead letter log
+	NotifyQueueSize int
+	// Attempts after a failed delivery, the default is 3
+	NotifyMaxRetries int
+	// Wait before the first retry, doubled for every following one. The default is 1s
+	NotifyBackoff time.Duration
+	// Timeout of one delivery attempt, the default is 10s
+	NotifyTimeout time.Duration
+	// Events that could not be delivered are written there as JSON lines, stderr when nil
+	DeadLetterLog io.Writer
+	// Writer of the default JSON output, stdout when nil
+	DefaultOutput io.Writer
+	// Turn the default JSON output off, e.g. when OutputCaller is a FileSink
+	DisableDefaultOutput bool
+	// Label keys that alerts are grouped by when reporting with labels. When nil, every label set is
+	// analyzed separately; otherwise the series sharing the same values for these keys are merged before
+	// the analysis, e.g. []string{"upstream"} alerts per upstream whatever the tenant. An empty, non-nil
+	// slice groups all the label sets of a name together
+	AlertLabels []string
+	// Rewrites every reported name before it is counted, e.g. NewPathNormalizer().Normalize to turn URLs
+	// into routes. It is called by the reporting goroutines and must be safe for concurrent use
+	NameNormalizer func(name string) string
+	// Maximum number of distinct names (after normalization) counted by the client, the reports of
+	// further names are counted under OtherName. The names whose entries are all evicted free their slot.
+	// 0, the default, does not limit names
+	MaxNames int
+	// The name of the reports beyond MaxNames, and of the overflow entry beyond MaxEntries, the default is "other"
+	OtherName string
+	// Maximum number of entries (a name with one label set, or an alert group) the client keeps. Reports that
+	// would create another one are counted in the OtherName entry instead. The entries of the event time windows
+	// that ReportAt keeps open count as well. 0, the default, does not limit entries
+	MaxEntries int
+	// Forget the entries that had no report for this many consecutive cycles, 0 (the default) keeps them forever
+	EvictAfterCycles int
+	// Called with every evicted entry, from the same goroutine as AlertCaller and RecoverCaller
+	EvictCaller func(event *EvictionEvent)
+	// How late a report made with ReportAt may arrive: the window of an event is output once the clock has
+	// passed its end by AllowedLateness, later events of the window are dropped and counted in Late.
+	// 0, the default, outputs a window at the first cycle after its end
+	AllowedLateness time.Duration
+	// Code of the error returned by an operation run by Observe, nil included (the success). The default is
+	// DefaultErrorClassifier, its CODE_* codes are named in FailDistribution through CodeFeatureMap
+	ErrorClassifier func(err error) int
+	// Entry configurations applied at registration, equivalent to calling AddEntryConfig for each of them
+	EntryConfigs map[string]EntryConfig
+	// Pattern entry configurations applied at registration in this order, as AddEntryConfigPattern does
+	EntryConfigPatterns []EntryConfigPattern
 
 	// Customize the url or name the attribute about the time-consuming reach, distribution interval,
 	//etc. To maintain internal key consistency, you need to call the method to set this property
-	entryConfigMap          map[string]EntryConfig
-	recentSuccessRateStatus map[string]*alertStatus
-	recentFastRateStatus    map[string]*alertStatus
-	taskChannel             chan *taskQueue
-	collectDataMap          map[string]*reportData
-	statisticsChannel       chan reportData
+	entryConfigMap      map[string]EntryConfig
+	entryConfigPatterns []entryConfigPattern
+	entryConfigCache    map[string]*EntryConfig
+	entryConfigLock     *sync.RWMutex
+	defaultEntryConfig  *EntryConfig
+	appliedDefaults     []AppliedDefault
+	alertRules          []AlertRule
+	alertStatusMap      map[string][]alertStatus
+	taskChannel         chan *taskQueue
+	controlChannel      chan *taskQueue
+	counters            *clientCounters
+	sharded             *shardedCollector
+	nameLimiter         *nameLimiter
+	collectDataMap      map[string]*reportData
+	statisticsChannel   chan reportData
+	// Entries of the open event time windows by window start (unix nanoseconds), and the watermark:
+	//the windows ending at or before it have been output. Both belong to the collector
+	eventWindows map[int64]map[string]*reportData
+	watermark    time.Time
+	// Shutdown coordination, without a lock that Report calls could queue behind
+	shutdown        *clientShutdown
+	stopChannel     chan struct{}
+	doneChannel     chan struct{}
+	callerWaitGroup *sync.WaitGroup
+	// Alarm notification delivery
+	alertCallQueue    *alertCallQueue
+	notifyDispatchers []*notifyDispatcher
+	notifyWaitGroup   *sync.WaitGroup
+	deadLetterLock    *sync.Mutex
+	// Cumulative metrics served by the Prometheus handler
+	metricsLock     *sync.Mutex
+	metricsMap      map[string]*entryMetrics
+	alertMetricsMap map[string]*alertMetrics
 }
 
 type CodeFeature struct {
@@ -70,69 +268,122 @@ type CodeFeature struct {
 
 // Register You have to register first to get a
 //unique client before you can use the upload
+// Out-of-range values are quietly replaced by defaults, an invalid configuration that cannot
+// be repaired (such as a missing name) causes a panic. Use NewClient to get the problems as an error
 func Register(c ReportClientConfig) ReportClient {
-	if c.Name == "" {
-		panic("A name must be registered for this reporting type")
-	}
-	// Maximum of 5 minutes allowed for a statistical cycle
-	if c.StatisticalCycle <= 0 || c.StatisticalCycle > 300000 {
-		c.StatisticalCycle = 60000
-	}
-	if c.AlertForBadFastRateReachedTimes < 3 {
-		c.AlertForBadFastRateReachedTimes = 3
-	}
-	if c.AlertForGreatFastRateReachedTimes < 3 {
-		c.AlertForGreatFastRateReachedTimes = 3
-	}
-	if c.AlertForBadSuccessRateReachedTimes < 3 {
-		c.AlertForBadSuccessRateReachedTimes = 3
-	}
-	if c.AlertForGreatSuccessRateReachedTimes < 3 {
-		c.AlertForGreatSuccessRateReachedTimes = 3
-	}
-	if c.SuccessRate == 0 {
-		c.SuccessRate = 0.95
-	}
-	if c.FastRate == 0 {
-		c.FastRate = 0.8
-	}
-	if c.ChannelCacheCount <= 0 {
-		c.ChannelCacheCount = 100
-	}
-	if c.DefaultFastTime > 0 {
-		defaultEntryConfig.FastLessThan = c.DefaultFastTime
+	client, err := newClient(c, &configChecker{})
+	if err != nil {
+		panic(err)
 	}
-	if c.DefaultFailDistributionFormat == "" {
-		c.DefaultFailDistributionFormat = "code[%code]"
+	return client
+}
+
+// NewClient Same as Register, but every field is validated: all invalid values are returned together
+// as a *ConfigError, and only unset values are completed with defaults (see ReportClient.AppliedDefaults)
+func NewClient(c ReportClientConfig) (ReportClient, error) {
+	client, err := newClient(c, &configChecker{strict: true})
+	if err != nil {
+		return nil, err
 	}
-	c.entryConfigMap = map[string]EntryConfig{}
-	c.recentFastRateStatus = map[string]*alertStatus{}
-	c.recentSuccessRateStatus = map[string]*alertStatus{}
-	// If no custom code feature recognition function is
-	//specified and the status code mapping is empty, then the default mechanism is enabled
-	if c.GetCodeFeature == nil && c.CodeFeatureMap == nil {
-		c.CodeFeatureMap = map[int]CodeFeature{
-			200: {
-				Success: true,
-			},
-		}
+	return client, nil
+}
+
+func newClient(c ReportClientConfig, k *configChecker) (*ReportClientConfig, error) {
+	c.normalize(k)
+	if err := k.err(); err != nil {
+		return nil, err
 	}
+	c.appliedDefaults = k.defaults
+	c.alertStatusMap = map[string][]alertStatus{}
 	client := &c
 	client.taskChannel = make(chan *taskQueue, c.ChannelCacheCount)
+	// Periodic tasks have their own channel, the overflow policies only ever discard reports
+	client.controlChannel = make(chan *taskQueue, 1)
+	client.counters = &clientCounters{}
+	if c.MaxNames > 0 {
+		client.nameLimiter = &nameLimiter{names: map[string]struct{}{}}
+	}
+	if c.CollectorShards > 0 {
+		client.sharded = newShardedCollector(c.CollectorShards)
+	}
 	client.statisticsChannel = make(chan reportData, c.ChannelCacheCount)
 	client.collectDataMap = map[string]*reportData{}
+	client.eventWindows = map[int64]map[string]*reportData{}
+	client.setWatermark(time.Now())
+	client.shutdown = &clientShutdown{}
+	client.stopChannel = make(chan struct{})
+	client.doneChannel = make(chan struct{})
+	client.callerWaitGroup = &sync.WaitGroup{}
+	client.metricsLock = &sync.Mutex{}
+	client.metricsMap = map[string]*entryMetrics{}
+	client.alertMetricsMap = map[string]*alertMetrics{}
+	client.entryConfigLock = &sync.RWMutex{}
+	client.alertCallQueue = newAlertCallQueue()
+	client.deadLetterLock = &sync.Mutex{}
+	client.startNotifiers()
+	registerClient(client)
 	go client.collect()
 	go client.scheduleTask()
 	go client.statistics()
-	return client
+	return client, nil
+}
+
+// AppliedDefaults See ReportClient.AppliedDefaults
+func (c *ReportClientConfig) AppliedDefaults() []AppliedDefault {
+	return append([]AppliedDefault(nil), c.appliedDefaults...)
 }
 
-func defaultOutputCaller(o *OutPutData) {
+// Close Shut down the client, see ReportClient.Close
+func (c *ReportClientConfig) Close(ctx context.Context) error {
+	if c.shutdown == nil {
+		return ErrNotRegistered
+	}
+	if c.shutdown.closed.CompareAndSwap(false, true) {
+		// Waking up the collector, which drains the reports in progress before the final flush
+		close(c.stopChannel)
+	}
+	select {
+	case <-c.doneChannel:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reports in progress are counted so that the collector knows when the task channel has nothing more to
+// receive after Close, no report is recorded once closed is set
+type clientShutdown struct {
+	closed  atomic.Bool
+	senders atomic.Int64
+}
+
+// Count a report in progress, false when the client is closed
+func (s *clientShutdown) enter() bool {
+	s.senders.Add(1)
+	if s.closed.Load() {
+		s.senders.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (s *clientShutdown) leave() {
+	s.senders.Add(-1)
+}
+
+// The default output writes every OutPutData as a line of JSON to DefaultOutput, stdout unless replaced
+func (c *ReportClientConfig) defaultOutputCaller(o *OutPutData) {
+	if c.DisableDefaultOutput {
+		return
+	}
+	w := c.DefaultOutput
+	if w == nil {
+		w = os.Stdout
+	}
 	b, err := json.Marshal(*o)
 	if err != nil {
 		os.Stderr.WriteString(err.Error())
 	} else {
-		os.Stdout.Write(b)
-		os.Stdout.WriteString("\n")
+		w.Write(append(b, '\n'))
 	}
 }
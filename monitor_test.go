@@ -0,0 +1,141 @@
+package monitor_tool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A DefaultOutput that blocks every write until released
+type blockingWriter struct {
+	blocked chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func newBlockingWriter() *blockingWriter {
+	return &blockingWriter{blocked: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.blocked) })
+	<-w.release
+	return len(p), nil
+}
+
+// Register a client whose output is stuck, with its task channel full and a BLOCK report waiting on it
+func stalledClient(t *testing.T) (ReportClient, *blockingWriter, chan error) {
+	t.Helper()
+	w := newBlockingWriter()
+	client := Register(ReportClientConfig{
+		Name:              "stalled",
+		StatisticalCycle:  10,
+		ChannelCacheCount: 1,
+		DefaultOutput:     w,
+	})
+	reported := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			if err := client.Report("entry", uint32(i%100), 200); err != nil {
+				reported <- err
+				return
+			}
+		}
+	}()
+	select {
+	case <-w.blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the output was never called")
+	}
+	// Leaves time for the statistics and task channels to fill up behind the stuck output
+	time.Sleep(100 * time.Millisecond)
+	return client, w, reported
+}
+
+func TestCloseRespectsContext(t *testing.T) {
+	client, w, reported := stalledClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := client.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Close returned %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Close returned after %v", elapsed)
+	}
+	select {
+	case err := <-reported:
+		if !errors.Is(err, ErrClientClosed) {
+			t.Fatalf("the blocked report returned %v, want ErrClientClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the blocked report did not give up after Close")
+	}
+	close(w.release)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Close(ctx); err != nil {
+		t.Fatalf("Close after the output was released returned %v", err)
+	}
+}
+
+func TestTryReportNeverBlocks(t *testing.T) {
+	client, w, reported := stalledClient(t)
+	tryReport := func() bool {
+		done := make(chan bool, 1)
+		go func() { done <- client.TryReport("entry", 1, 200) }()
+		select {
+		case ok := <-done:
+			return ok
+		case <-time.After(time.Second):
+			t.Fatal("TryReport blocked")
+			return false
+		}
+	}
+	if tryReport() {
+		t.Fatal("TryReport succeeded on a full task channel")
+	}
+	// Close waits for the stuck output, reporting must not queue behind it
+	closed := make(chan error, 1)
+	go func() { closed <- client.Close(context.Background()) }()
+	<-reported
+	if tryReport() {
+		t.Fatal("TryReport succeeded on a closed client")
+	}
+	if err := client.Report("entry", 1, 200); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("Report returned %v, want ErrClientClosed", err)
+	}
+	close(w.release)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("Close returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not complete after the output was released")
+	}
+}
+
+func TestSampleKeepsReportsOfAnIdleChannel(t *testing.T) {
+	client, outputs := collectingClient(t, ReportClientConfig{
+		Name:              "sample",
+		StatisticalCycle:  60000,
+		ChannelCacheCount: 1,
+		OverflowPolicy:    SAMPLE,
+	})
+	for i := 0; i < 5; i++ {
+		if err := client.Report("entry", 1, 200); err != nil {
+			t.Fatalf("report %d returned %v", i, err)
+		}
+		// Leaves time for the collector to empty the channel
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := client.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := outputs(); len(got) != 1 || got[0].Count != 5 || got[0].DroppedCount != 0 {
+		t.Fatalf("outputs %+v, want 5 reports and none dropped", got)
+	}
+}
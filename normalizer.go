@@ -0,0 +1,130 @@
+package monitor_tool
+
+import (
+	"strings"
+	"sync"
+)
+
+// PathNormalizer Turns URLs into stable report names, use its Normalize method as the NameNormalizer of a
+// client. The query string and the fragment are removed, then a path matching one of the Routes is reported
+// as that route, otherwise numeric ids, UUIDs and hexadecimal hashes are replaced by {id}, {uuid} and {hash}:
+// /users/42/orders?page=2 becomes /users/{id}/orders.
+// A name may start with a method, "GET /users/42" becomes "GET /users/{id}"
+type PathNormalizer struct {
+	routes [][]string
+}
+
+// NewPathNormalizer Routes are templates such as /users/{id}/orders, where a segment in braces matches any
+// single segment. They are tried in order, the first match wins
+func NewPathNormalizer(routes ...string) *PathNormalizer {
+	n := &PathNormalizer{}
+	for _, route := range routes {
+		n.routes = append(n.routes, strings.Split(route, "/"))
+	}
+	return n
+}
+
+// Normalize Safe for concurrent use
+func (n *PathNormalizer) Normalize(name string) string {
+	var method string
+	if i := strings.IndexByte(name, ' '); i >= 0 && strings.HasPrefix(name[i+1:], "/") {
+		method, name = name[:i+1], name[i+1:]
+	}
+	if i := strings.IndexAny(name, "?#"); i >= 0 {
+		name = name[:i]
+	}
+	segments := strings.Split(name, "/")
+	for _, route := range n.routes {
+		if matchRoute(route, segments) {
+			return method + strings.Join(route, "/")
+		}
+	}
+	for i, segment := range segments {
+		switch {
+		case segment == "":
+		case isDigits(segment):
+			segments[i] = "{id}"
+		case isUUID(segment):
+			segments[i] = "{uuid}"
+		case len(segment) >= 16 && isHex(segment):
+			segments[i] = "{hash}"
+		}
+	}
+	return method + strings.Join(segments, "/")
+}
+
+func matchRoute(route []string, segments []string) bool {
+	if len(route) != len(segments) {
+		return false
+	}
+	for i, part := range route {
+		if part != segments[i] && !(len(part) > 2 && part[0] == '{' && part[len(part)-1] == '}' && segments[i] != "") {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !(s[i] >= '0' && s[i] <= '9') && !(s[i] >= 'a' && s[i] <= 'f') && !(s[i] >= 'A' && s[i] <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// 8-4-4-4-12 hexadecimal digits
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if i == 8 || i == 13 || i == 18 || i == 23 {
+			if s[i] != '-' {
+				return false
+			}
+		} else if !isHex(s[i : i+1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Distinct names seen by a client with MaxNames, once full further names are reported as OtherName
+type nameLimiter struct {
+	lock  sync.RWMutex
+	names map[string]struct{}
+}
+
+// The name under which a report is counted
+func (c *ReportClientConfig) reportName(name string) string {
+	if c.NameNormalizer != nil {
+		name = c.NameNormalizer(name)
+	}
+	if c.nameLimiter == nil {
+		return name
+	}
+	c.nameLimiter.lock.RLock()
+	_, ok := c.nameLimiter.names[name]
+	c.nameLimiter.lock.RUnlock()
+	if ok {
+		return name
+	}
+	c.nameLimiter.lock.Lock()
+	defer c.nameLimiter.lock.Unlock()
+	if _, ok := c.nameLimiter.names[name]; ok || len(c.nameLimiter.names) < c.MaxNames {
+		c.nameLimiter.names[name] = struct{}{}
+		return name
+	}
+	return c.OtherName
+}
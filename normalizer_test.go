@@ -0,0 +1,70 @@
+package monitor_tool
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPathNormalizer(t *testing.T) {
+	n := NewPathNormalizer("/teams/{team}/members")
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{"/users/42/orders?page=2", "/users/{id}/orders"},
+		{"/users/42#profile", "/users/{id}"},
+		{"/orders/123e4567-e89b-12d3-a456-426614174000", "/orders/{uuid}"},
+		{"/orders/123E4567-E89B-12D3-A456-426614174000/items/7", "/orders/{uuid}/items/{id}"},
+		{"/blobs/0123456789abcdef0123456789abcdef", "/blobs/{hash}"},
+		{"/blobs/0123456789ABCDEF", "/blobs/{hash}"},
+		// Hexadecimal words and short hashes are names
+		{"/coffee/cafe/beef", "/coffee/cafe/beef"},
+		{"/commits/deadbeef", "/commits/deadbeef"},
+		{"/blobs/0123456789abcde", "/blobs/0123456789abcde"},
+		{"/users/42abc", "/users/42abc"},
+		// Names without a leading slash
+		{"users/42", "users/{id}"},
+		{"42", "{id}"},
+		{"health", "health"},
+		{"", ""},
+		// Methods and routes
+		{"GET /users/42?full=1", "GET /users/{id}"},
+		{"/teams/42/members", "/teams/{team}/members"},
+		{"POST /teams/core/members", "POST /teams/{team}/members"},
+		{"/teams//members", "/teams//members"},
+	} {
+		if got := n.Normalize(test.name); got != test.want {
+			t.Errorf("%q was normalized to %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMaxNamesOverflow(t *testing.T) {
+	client, outputs := collectingClient(t, ReportClientConfig{
+		Name:             "names",
+		StatisticalCycle: 60000,
+		NameNormalizer:   NewPathNormalizer().Normalize,
+		MaxNames:         2,
+	})
+	for _, name := range []string{"/users/1", "/users/2", "/orders/1", "/carts/1", "/carts/2", "/users/3", "/search?q=a"} {
+		if err := client.Report(name, 1, 200); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]uint32{}
+	for _, o := range outputs() {
+		counts[o.InterfaceName] += o.Count
+	}
+	want := map[string]uint32{"/users/{id}": 3, "/orders/{id}": 1, "other": 3}
+	if len(counts) != len(want) {
+		t.Fatalf("counts %v, want %v", counts, want)
+	}
+	for name, count := range want {
+		if counts[name] != count {
+			t.Fatalf("counts %v, want %v", counts, want)
+		}
+	}
+}
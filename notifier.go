@@ -0,0 +1,309 @@
+package monitor_tool
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AlertEventKind Whether an event raises an alarm or announces its recovery
+type AlertEventKind uint8
+
+const (
+	// ALERTING The alarm condition was reached
+	ALERTING AlertEventKind = iota
+	// RECOVERED The entry is healthy again after an alarm
+	RECOVERED
+)
+
+func (k AlertEventKind) String() string {
+	if k == RECOVERED {
+		return "RECOVERED"
+	}
+	return "ALERTING"
+}
+
+func (k AlertEventKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (t AlertType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// AlertEvent Everything a Notifier knows about an alarm or a recovery
+type AlertEvent struct {
+	Kind          AlertEventKind    `json:"kind"`
+	ClientName    string            `json:"clientName"`
+	InterfaceName string            `json:"interfaceName"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	AlertType     AlertType         `json:"alertType"`
+	Severity      string            `json:"severity"`
+	// Name of the AlertRule, FAIL or SLOW for the built-in rules, and the labels of the rule
+	Rule       string            `json:"rule"`
+	RuleLabels map[string]string `json:"ruleLabels,omitempty"`
+	// The rule condition and the value of the latest period
+	Metric    string  `json:"metric"`
+	Op        string  `json:"op"`
+	Threshold float64 `json:"threshold"`
+	Value     float64 `json:"value"`
+	// Stable identifier of the alarm: the same client, entry (labels included) and rule always give the same
+	// fingerprint, so that a recovery can be matched with its alarm. The built-in rules are named after
+	// their type
+	Fingerprint string    `json:"fingerprint"`
+	Time        time.Time `json:"time"`
+	// The consecutive periods that raised the alarm or confirmed the recovery
+	RecentOutputData []OutPutData `json:"recentOutputData"`
+}
+
+// Notifier Delivers alarm and recovery events, see ReportClientConfig.Notifiers.
+// Notify is called by a delivery goroutine of the client with a context bounded by NotifyTimeout,
+// a returned error makes the delivery retry with an exponential backoff
+type Notifier interface {
+	Notify(ctx context.Context, event *AlertEvent) error
+}
+
+// WebhookNotifier POSTs every event as JSON, any status other than 2xx is an error
+type WebhookNotifier struct {
+	URL string
+	// Headers added to every request, e.g. Authorization
+	Headers map[string]string
+	// The default is http.DefaultClient, timeouts come from the context of Notify
+	Client *http.Client
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, event *AlertEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for k, v := range n.Headers {
+		request.Header.Set(k, v)
+	}
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return errors.New("webhook answered " + response.Status)
+	}
+	return nil
+}
+
+// One queue and one goroutine per notifier, so that a slow notifier never delays the others
+type notifyDispatcher struct {
+	client   *ReportClientConfig
+	notifier Notifier
+	queue    chan *AlertEvent
+}
+
+func (c *ReportClientConfig) startNotifiers() {
+	c.notifyWaitGroup = &sync.WaitGroup{}
+	for _, notifier := range c.Notifiers {
+		d := &notifyDispatcher{
+			client:   c,
+			notifier: notifier,
+			queue:    make(chan *AlertEvent, c.NotifyQueueSize),
+		}
+		c.notifyDispatchers = append(c.notifyDispatchers, d)
+		c.notifyWaitGroup.Add(1)
+		go d.deliver()
+	}
+}
+
+// Called once no more alarm analysis is running, the queued events are still delivered
+func (c *ReportClientConfig) stopNotifiers() {
+	for _, d := range c.notifyDispatchers {
+		close(d.queue)
+	}
+	c.notifyWaitGroup.Wait()
+}
+
+// Hand an alarm or a recovery over to the custom callers (or the default one) and to every notifier,
+// neither of them is called from the analysis itself.
+// The default stderr notice is only written when neither a caller nor a notifier is configured
+func (c *ReportClientConfig) notify(key string, kind AlertEventKind, rule *AlertRule, outputData *OutPutData, recentOutputData []OutPutData) {
+	caller, defaultCaller := c.AlertCaller, defaultAlert
+	if kind == RECOVERED {
+		caller, defaultCaller = c.RecoverCaller, defaultRecover
+	}
+	// The analysis reuses its slices, everything handed over needs its own copy
+	recentOutputData = append([]OutPutData(nil), recentOutputData...)
+	clientName, interfaceName, alertType := c.Name, outputData.InterfaceName, rule.Type
+	if caller != nil {
+		c.alertCallQueue.push(func() {
+			caller(clientName, interfaceName, alertType, recentOutputData)
+		})
+	} else if len(c.notifyDispatchers) == 0 && c.AlertEventCaller == nil {
+		if rule.builtin {
+			c.alertCallQueue.push(func() {
+				defaultCaller(clientName, interfaceName, alertType, recentOutputData)
+			})
+		} else {
+			ruleCopy := *rule
+			c.alertCallQueue.push(func() {
+				defaultRuleNotice(c, kind, clientName, interfaceName, &ruleCopy, recentOutputData)
+			})
+		}
+	}
+	if len(c.notifyDispatchers) == 0 && c.AlertEventCaller == nil {
+		return
+	}
+	// The built-in rules are named after their type, their fingerprints are the same as before rules existed
+	fingerprint := sha256.Sum256([]byte(c.Name + "\x00" + key + "\x00" + rule.Name))
+	_, value := rule.evaluate(c, outputData)
+	event := &AlertEvent{
+		Kind:             kind,
+		ClientName:       c.Name,
+		InterfaceName:    outputData.InterfaceName,
+		Labels:           outputData.Labels,
+		AlertType:        alertType,
+		Severity:         rule.Severity,
+		Rule:             rule.Name,
+		RuleLabels:       rule.Labels,
+		Metric:           rule.Metric,
+		Op:               rule.Op,
+		Threshold:        rule.Threshold,
+		Value:            value,
+		Fingerprint:      hex.EncodeToString(fingerprint[:8]),
+		Time:             outputData.Timestamp,
+		RecentOutputData: recentOutputData,
+	}
+	if eventCaller := c.AlertEventCaller; eventCaller != nil {
+		c.alertCallQueue.push(func() {
+			eventCaller(event)
+		})
+	}
+	for _, d := range c.notifyDispatchers {
+		select {
+		case d.queue <- event:
+		default:
+			c.deadLetter(event, errors.New("the notification queue is full"))
+		}
+	}
+}
+
+func (d *notifyDispatcher) deliver() {
+	defer d.client.notifyWaitGroup.Done()
+	c := d.client
+	for event := range d.queue {
+		backoff := c.NotifyBackoff
+		var err error
+		for attempt := 0; attempt <= c.NotifyMaxRetries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), c.NotifyTimeout)
+			err = d.notifier.Notify(ctx, event)
+			cancel()
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			c.deadLetter(event, err)
+		}
+	}
+}
+
+// Events that could not be delivered are written as a line of JSON to DeadLetterLog
+func (c *ReportClientConfig) deadLetter(event *AlertEvent, err error) {
+	c.deadLetterLock.Lock()
+	defer c.deadLetterLock.Unlock()
+	b, marshalErr := json.Marshal(struct {
+		Error string      `json:"error"`
+		Event *AlertEvent `json:"event"`
+	}{err.Error(), event})
+	if marshalErr != nil {
+		os.Stderr.WriteString(marshalErr.Error())
+		return
+	}
+	w := c.DeadLetterLog
+	if w == nil {
+		w = os.Stderr
+	}
+	w.Write(append(b, '\n'))
+}
+
+// alertCallQueue Unbounded FIFO between the alarm analysis and the custom alarm and recovery callers:
+// the analysis never waits for a slow caller, and the calls still happen one at a time in order
+type alertCallQueue struct {
+	lock   sync.Mutex
+	calls  []func()
+	closed bool
+	signal chan struct{}
+	done   chan struct{}
+}
+
+func newAlertCallQueue() *alertCallQueue {
+	q := &alertCallQueue{
+		signal: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *alertCallQueue) push(call func()) {
+	q.lock.Lock()
+	q.calls = append(q.calls, call)
+	q.lock.Unlock()
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Run the remaining calls and wait for them
+func (q *alertCallQueue) close() {
+	q.lock.Lock()
+	q.closed = true
+	q.lock.Unlock()
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+	<-q.done
+}
+
+func (q *alertCallQueue) run() {
+	defer close(q.done)
+	for range q.signal {
+		for {
+			q.lock.Lock()
+			if len(q.calls) == 0 {
+				closed := q.closed
+				q.lock.Unlock()
+				if closed {
+					return
+				}
+				break
+			}
+			call := q.calls[0]
+			q.calls[0] = nil
+			q.calls = q.calls[1:]
+			q.lock.Unlock()
+			call()
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package monitor_tool
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The fields of an AlertEvent checked by the tests, as received by the endpoint
+type receivedEvent struct {
+	Kind             string       `json:"kind"`
+	ClientName       string       `json:"clientName"`
+	InterfaceName    string       `json:"interfaceName"`
+	AlertType        string       `json:"alertType"`
+	Rule             string       `json:"rule"`
+	Fingerprint      string       `json:"fingerprint"`
+	RecentOutputData []OutPutData `json:"recentOutputData"`
+}
+
+// Register a client whose single rule alarms on the first report, with a webhook notifier on the URL
+func webhookClient(t *testing.T, url string, deadLetters *bytes.Buffer, config ReportClientConfig) ReportClient {
+	t.Helper()
+	config.Name = "webhook"
+	config.StatisticalCycle = 60000
+	config.DisableDefaultOutput = true
+	config.DisableDefaultAlertRules = true
+	config.AlertRules = []AlertRule{{Name: "busy", Metric: "count", Op: ">=", Threshold: 1, For: 1}}
+	config.Notifiers = []Notifier{&WebhookNotifier{URL: url, Headers: map[string]string{"Authorization": "Bearer token"}}}
+	config.DeadLetterLog = deadLetters
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Report("entry", 1, 200)
+	return client
+}
+
+func TestWebhookRetries(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		failures int64
+		attempts int64
+	}{
+		{"delivered after failures", 2, 3},
+		{"failed every attempt", 10, 3},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var attempts atomic.Int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempt := attempts.Add(1)
+				var event receivedEvent
+				if err := json.NewDecoder(r.Body).Decode(&event); err != nil || event.Rule != "busy" || event.Kind != "ALERTING" {
+					t.Errorf("attempt %d received %+v (%v)", attempt, event, err)
+				}
+				if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+					t.Errorf("attempt %d has the Authorization %q", attempt, auth)
+				}
+				if attempt <= c.failures {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+			defer server.Close()
+			var deadLetters bytes.Buffer
+			client := webhookClient(t, server.URL, &deadLetters, ReportClientConfig{NotifyMaxRetries: 2, NotifyBackoff: time.Millisecond})
+			if err := client.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := attempts.Load(); got != c.attempts {
+				t.Fatalf("%d attempts, want %d", got, c.attempts)
+			}
+			if c.failures < c.attempts {
+				if deadLetters.Len() > 0 {
+					t.Fatalf("dead letters of a delivered event: %s", deadLetters.String())
+				}
+				return
+			}
+			var deadLetter struct {
+				Error string         `json:"error"`
+				Event *receivedEvent `json:"event"`
+			}
+			if err := json.Unmarshal(deadLetters.Bytes(), &deadLetter); err != nil {
+				t.Fatalf("dead letters %q: %v", deadLetters.String(), err)
+			}
+			if deadLetter.Error != "webhook answered 503 Service Unavailable" {
+				t.Fatalf("the dead letter has the error %q", deadLetter.Error)
+			}
+			if e := deadLetter.Event; e == nil || e.ClientName != "webhook" || e.InterfaceName != "entry" || e.AlertType != "RULE" || e.Rule != "busy" || e.Fingerprint == "" || len(e.RecentOutputData) != 1 {
+				t.Fatalf("the dead letter has the event %+v", e)
+			}
+		})
+	}
+}
+
+func TestCloseDoesNotHangOnAStuckWebhook(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	var deadLetters bytes.Buffer
+	client := webhookClient(t, server.URL, &deadLetters, ReportClientConfig{
+		NotifyMaxRetries: 1,
+		NotifyBackoff:    time.Millisecond,
+		NotifyTimeout:    50 * time.Millisecond,
+	})
+	closed := make(chan error, 1)
+	go func() { closed <- client.Close(context.Background()) }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close is waiting for the stuck webhook")
+	}
+	if !strings.Contains(deadLetters.String(), "context deadline exceeded") {
+		t.Fatalf("dead letters %q, want the event with the timeout", deadLetters.String())
+	}
+}
@@ -0,0 +1,125 @@
+package monitor_tool
+
+import (
+	"path"
+	"regexp"
+)
+
+// MatchKind How the pattern of an EntryConfigPattern matches names
+type MatchKind uint8
+
+const (
+	// PREFIX Names starting with the pattern, e.g. /api/v1/
+	PREFIX MatchKind = iota
+	// GLOB Names matched by the pattern in the syntax of path.Match, * does not cross a /, e.g. /api/*/users
+	GLOB
+	// REGEX Names in which the regular expression finds a match, anchor it with ^ and $ to match whole names
+	REGEX
+)
+
+// EntryConfigPattern An entry configuration applying to every name that matches a pattern.
+// A name takes the configuration added for it by name, else that of the longest matching PREFIX pattern,
+// else that of the first matching GLOB or REGEX pattern in the order they were added, else the default
+type EntryConfigPattern struct {
+	Kind    MatchKind
+	Pattern string
+	Config  EntryConfig
+}
+
+type entryConfigPattern struct {
+	EntryConfigPattern
+	regexp *regexp.Regexp
+}
+
+// AddEntryConfigPattern Same as AddEntryConfig for every name matching the pattern, adding the same
+// pattern again replaces its configuration. An invalid pattern causes a panic
+func (c *ReportClientConfig) AddEntryConfigPattern(kind MatchKind, pattern string, entryConfig EntryConfig) {
+	if err := c.setEntryConfigPattern(EntryConfigPattern{kind, pattern, entryConfig}, &configChecker{}); err != nil {
+		panic(err)
+	}
+}
+
+// SetEntryConfigPattern See ReportClient.SetEntryConfigPattern
+func (c *ReportClientConfig) SetEntryConfigPattern(kind MatchKind, pattern string, entryConfig EntryConfig) error {
+	return c.setEntryConfigPattern(EntryConfigPattern{kind, pattern, entryConfig}, &configChecker{strict: true})
+}
+
+func (c *ReportClientConfig) setEntryConfigPattern(p EntryConfigPattern, k *configChecker) error {
+	compiled := c.normalizePattern(p, k)
+	if err := k.err(); err != nil {
+		return err
+	}
+	c.entryConfigLock.Lock()
+	defer c.entryConfigLock.Unlock()
+	c.entryConfigCache = map[string]*EntryConfig{}
+	c.putEntryConfigPattern(compiled)
+	return nil
+}
+
+// A pattern added again keeps its place in the order
+func (c *ReportClientConfig) putEntryConfigPattern(compiled entryConfigPattern) {
+	for i, existing := range c.entryConfigPatterns {
+		if existing.Kind == compiled.Kind && existing.Pattern == compiled.Pattern {
+			c.entryConfigPatterns[i] = compiled
+			return
+		}
+	}
+	c.entryConfigPatterns = append(c.entryConfigPatterns, compiled)
+}
+
+func (c *ReportClientConfig) normalizePattern(p EntryConfigPattern, k *configChecker) entryConfigPattern {
+	k.entry = p.Pattern
+	compiled := entryConfigPattern{EntryConfigPattern: p}
+	switch p.Kind {
+	case PREFIX:
+	case GLOB:
+		if _, err := path.Match(p.Pattern, ""); err != nil {
+			k.problem("Pattern", p.Pattern, err.Error())
+		}
+	case REGEX:
+		var err error
+		if compiled.regexp, err = regexp.Compile(p.Pattern); err != nil {
+			k.problem("Pattern", p.Pattern, err.Error())
+		}
+	default:
+		k.problem("Kind", p.Kind, "unknown match kind")
+	}
+	compiled.Config.normalize(k, c.defaultEntryConfig)
+	return compiled
+}
+
+// The configuration of the pattern that applies to the name, nil when none matches.
+// Called under entryConfigLock
+func (c *ReportClientConfig) matchEntryConfigPattern(name string) *EntryConfig {
+	var prefix *entryConfigPattern
+	for i := range c.entryConfigPatterns {
+		p := &c.entryConfigPatterns[i]
+		if p.Kind == PREFIX && len(name) >= len(p.Pattern) && name[:len(p.Pattern)] == p.Pattern &&
+			(prefix == nil || len(p.Pattern) > len(prefix.Pattern)) {
+			prefix = p
+		}
+	}
+	if prefix != nil {
+		return prefix.config()
+	}
+	for i := range c.entryConfigPatterns {
+		p := &c.entryConfigPatterns[i]
+		switch p.Kind {
+		case GLOB:
+			if matched, _ := path.Match(p.Pattern, name); matched {
+				return p.config()
+			}
+		case REGEX:
+			if p.regexp.MatchString(name) {
+				return p.config()
+			}
+		}
+	}
+	return nil
+}
+
+// A copy, the entries keep their configuration when the pattern is replaced
+func (p *entryConfigPattern) config() *EntryConfig {
+	config := p.Config
+	return &config
+}
@@ -0,0 +1,54 @@
+package monitor_tool
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEntryConfigPrecedence(t *testing.T) {
+	c, err := newClient(ReportClientConfig{Name: "patterns", DisableDefaultOutput: true}, &configChecker{strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(context.Background())
+	// Each configuration is told apart by its FastLessThan
+	patterns := []EntryConfigPattern{
+		{PREFIX, "/api/v1/", EntryConfig{FastLessThan: 300}},
+		{PREFIX, "/api/", EntryConfig{FastLessThan: 200}},
+		{GLOB, "/api/*/users/*", EntryConfig{FastLessThan: 400}},
+		{REGEX, "^/api/v1/users/[0-9]+$", EntryConfig{FastLessThan: 500}},
+		{REGEX, "users", EntryConfig{FastLessThan: 600}},
+		{GLOB, "/static/*", EntryConfig{FastLessThan: 700}},
+		{REGEX, "^/static/", EntryConfig{FastLessThan: 800}},
+	}
+	for _, p := range patterns {
+		if err := c.SetEntryConfigPattern(p.Kind, p.Pattern, p.Config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.SetEntryConfig("/api/v1/users/me", EntryConfig{FastLessThan: 100}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		want uint32
+	}{
+		// The exact name before any pattern
+		{"/api/v1/users/me", 100},
+		// The longest prefix, whatever the order the prefixes were added in, before globs and regular expressions
+		{"/api/v1/users/42", 300},
+		{"/api/v2/users/42", 200},
+		{"/api/", 200},
+		// Globs and regular expressions in the order they were added, * does not cross a /
+		{"/v1/users/42", 600},
+		{"/static/app.js", 700},
+		{"/static/js/app.js", 800},
+		// The default
+		{"/api", 500},
+		{"/health", 500},
+	} {
+		if got := c.getEntryConfig(test.name).FastLessThan; got != test.want {
+			t.Errorf("%s has the configuration %d, want %d", test.name, got, test.want)
+		}
+	}
+}
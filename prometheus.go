@@ -0,0 +1,385 @@
+package monitor_tool
+
+import (
+	"bufio"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registered clients, the default scope of the Prometheus handler
+var (
+	clientRegistryLock = &sync.Mutex{}
+	clientRegistry     = map[*ReportClientConfig]struct{}{}
+)
+
+// Cumulative metrics of one output series, maintained by the statistics goroutine from every OutPutData.
+// Prometheus counters must be monotonic, so the per-period figures are accumulated here
+type entryMetrics struct {
+	name         string
+	labels       map[string]string
+	latest       OutPutData
+	requests     uint64
+	success      uint64
+	fail         uint64
+	fast         uint64
+	failByCode   map[string]uint64
+	boundsUs     []uint64
+	buckets      []uint64
+	successUsSum uint64
+}
+
+// Latest alarm states of one analyzed key, by rule name
+type alertMetrics struct {
+	name   string
+	labels map[string]string
+	states map[string]alertState
+}
+
+type alertState struct {
+	alertType AlertType
+	alerting  bool
+}
+
+func registerClient(c *ReportClientConfig) {
+	clientRegistryLock.Lock()
+	clientRegistry[c] = struct{}{}
+	clientRegistryLock.Unlock()
+}
+
+func unregisterClient(c *ReportClientConfig) {
+	clientRegistryLock.Lock()
+	delete(clientRegistry, c)
+	clientRegistryLock.Unlock()
+}
+
+// Accumulate one statistical cycle into the metrics of its series
+func (c *ReportClientConfig) updateMetrics(collectedData *reportData, outputData *OutPutData) {
+	c.metricsLock.Lock()
+	defer c.metricsLock.Unlock()
+	m := c.metricsMap[collectedData.Key]
+	if m == nil {
+		m = &entryMetrics{
+			name:       collectedData.Name,
+			labels:     collectedData.Labels,
+			failByCode: map[string]uint64{},
+		}
+		c.metricsMap[collectedData.Key] = m
+	}
+	// The boundaries only change if the entry configuration does, the histogram restarts then
+	if !equalBounds(m.boundsUs, collectedData.Config.boundsUs) {
+		m.boundsUs = collectedData.Config.boundsUs
+		m.buckets = make([]uint64, len(m.boundsUs)+1)
+	}
+	m.latest = *outputData
+	m.requests += uint64(outputData.Count)
+	m.success += uint64(outputData.SuccessCount)
+	m.fail += uint64(outputData.FailCount)
+	m.fast += uint64(outputData.FastCount)
+	m.successUsSum += collectedData.SuccessUsCount
+	for name, count := range outputData.FailDistribution {
+		m.failByCode[name] += uint64(count)
+	}
+	for i, count := range collectedData.TimeConsumingDistribution {
+		m.buckets[i] += uint64(count)
+	}
+}
+
+// Publish the alarm state of a key whenever the analysis changes it
+func (c *ReportClientConfig) updateAlertMetrics(key string, outputData *OutPutData, rule *AlertRule, alerting bool) {
+	c.metricsLock.Lock()
+	defer c.metricsLock.Unlock()
+	m := c.alertMetricsMap[key]
+	if m == nil {
+		m = &alertMetrics{
+			name:   outputData.InterfaceName,
+			labels: outputData.Labels,
+			states: map[string]alertState{},
+		}
+		c.alertMetricsMap[key] = m
+	}
+	m.states[rule.Name] = alertState{alertType: rule.Type, alerting: alerting}
+}
+
+func equalBounds(a []uint64, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// A consistent copy of the metrics of one client, taken under its lock
+type clientMetricsSnapshot struct {
+	clientName string
+	dropped    uint64
+	evicted    uint64
+	late       uint64
+	entries    []entryMetrics
+	alerts     []alertMetrics
+}
+
+func (c *ReportClientConfig) metricsSnapshot() clientMetricsSnapshot {
+	c.metricsLock.Lock()
+	defer c.metricsLock.Unlock()
+	snapshot := clientMetricsSnapshot{clientName: c.Name, dropped: c.Dropped(), evicted: c.Evicted(), late: c.Late()}
+	keys := make([]string, 0, len(c.metricsMap))
+	for key := range c.metricsMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		m := *c.metricsMap[key]
+		m.failByCode = make(map[string]uint64, len(m.failByCode))
+		for name, count := range c.metricsMap[key].failByCode {
+			m.failByCode[name] = count
+		}
+		m.buckets = append([]uint64(nil), m.buckets...)
+		snapshot.entries = append(snapshot.entries, m)
+	}
+	keys = keys[:0]
+	for key := range c.alertMetricsMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		m := *c.alertMetricsMap[key]
+		m.states = make(map[string]alertState, len(m.states))
+		for name, state := range c.alertMetricsMap[key].states {
+			m.states[name] = state
+		}
+		snapshot.alerts = append(snapshot.alerts, m)
+	}
+	return snapshot
+}
+
+type prometheusHandler struct {
+	clients []*ReportClientConfig
+}
+
+// NewPrometheusHandler An http.Handler serving the metrics of the given clients in the Prometheus text
+// exposition format, or those of every registered client that has not been closed when none is given.
+// Counters (requests, successes, failures by code, fast requests and the latency histogram) are
+// cumulative since registration, rates and percentiles are gauges of the latest statistical cycle.
+// Latencies are in milliseconds, a histogram bucket le="X" counts the successes that took X or less
+func NewPrometheusHandler(clients ...ReportClient) http.Handler {
+	h := &prometheusHandler{}
+	for _, client := range clients {
+		if c, ok := client.(*ReportClientConfig); ok {
+			h.clients = append(h.clients, c)
+		}
+	}
+	return h
+}
+
+func (h *prometheusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	clients := h.clients
+	if clients == nil {
+		clientRegistryLock.Lock()
+		for c := range clientRegistry {
+			clients = append(clients, c)
+		}
+		clientRegistryLock.Unlock()
+	}
+	snapshots := make([]clientMetricsSnapshot, 0, len(clients))
+	for _, c := range clients {
+		snapshots = append(snapshots, c.metricsSnapshot())
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].clientName < snapshots[j].clientName
+	})
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	writePrometheus(out, snapshots)
+	out.Flush()
+}
+
+func writePrometheus(out *bufio.Writer, snapshots []clientMetricsSnapshot) {
+	counter := func(name string, help string, value func(m *entryMetrics) uint64) {
+		writeFamily(out, name, help, "counter")
+		for _, s := range snapshots {
+			for i := range s.entries {
+				writeSample(out, name, seriesLabels(s.clientName, &s.entries[i]), strconv.FormatUint(value(&s.entries[i]), 10))
+			}
+		}
+	}
+	gauge := func(name string, help string, value func(m *entryMetrics) float64) {
+		writeFamily(out, name, help, "gauge")
+		for _, s := range snapshots {
+			for i := range s.entries {
+				writeSample(out, name, seriesLabels(s.clientName, &s.entries[i]), formatFloat(value(&s.entries[i])))
+			}
+		}
+	}
+	counter("monitor_requests_total", "Reported calls.", func(m *entryMetrics) uint64 { return m.requests })
+	counter("monitor_success_total", "Successful calls.", func(m *entryMetrics) uint64 { return m.success })
+	counter("monitor_fail_total", "Failed calls.", func(m *entryMetrics) uint64 { return m.fail })
+	counter("monitor_fast_total", "Successful calls within the fast time.", func(m *entryMetrics) uint64 { return m.fast })
+	gauge("monitor_success_rate", "Success rate of the latest statistical cycle.", func(m *entryMetrics) float64 { return m.latest.SuccessRate })
+	gauge("monitor_fast_rate", "Fast rate of the latest statistical cycle.", func(m *entryMetrics) float64 { return m.latest.FastRate })
+
+	writeFamily(out, "monitor_dropped_reports_total", "Reports dropped by the overflow policy.", "counter")
+	for _, s := range snapshots {
+		writeSample(out, "monitor_dropped_reports_total", [][2]string{{"client", s.clientName}}, strconv.FormatUint(s.dropped, 10))
+	}
+
+	writeFamily(out, "monitor_evicted_entries_total", "Entries evicted for being idle.", "counter")
+	for _, s := range snapshots {
+		writeSample(out, "monitor_evicted_entries_total", [][2]string{{"client", s.clientName}}, strconv.FormatUint(s.evicted, 10))
+	}
+
+	writeFamily(out, "monitor_late_reports_total", "Events dropped for arriving after the allowed lateness.", "counter")
+	for _, s := range snapshots {
+		writeSample(out, "monitor_late_reports_total", [][2]string{{"client", s.clientName}}, strconv.FormatUint(s.late, 10))
+	}
+
+	writeFamily(out, "monitor_fail_by_code_total", "Failed calls by code.", "counter")
+	for _, s := range snapshots {
+		for i := range s.entries {
+			m := &s.entries[i]
+			names := make([]string, 0, len(m.failByCode))
+			for name := range m.failByCode {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				labels := append(seriesLabels(s.clientName, m), [2]string{"code", name})
+				writeSample(out, "monitor_fail_by_code_total", labels, strconv.FormatUint(m.failByCode[name], 10))
+			}
+		}
+	}
+
+	writeFamily(out, "monitor_latency_ms", "Elapsed time of successful calls in milliseconds.", "histogram")
+	for _, s := range snapshots {
+		for i := range s.entries {
+			m := &s.entries[i]
+			labels := seriesLabels(s.clientName, m)
+			var cumulative uint64
+			for b, bound := range m.boundsUs {
+				cumulative += m.buckets[b]
+				writeSample(out, "monitor_latency_ms_bucket", append(labels, [2]string{"le", formatUsAsMs(bound)}), strconv.FormatUint(cumulative, 10))
+			}
+			writeSample(out, "monitor_latency_ms_bucket", append(labels, [2]string{"le", "+Inf"}), strconv.FormatUint(m.success, 10))
+			writeSample(out, "monitor_latency_ms_sum", labels, formatUsAsMs(m.successUsSum))
+			writeSample(out, "monitor_latency_ms_count", labels, strconv.FormatUint(m.success, 10))
+		}
+	}
+
+	writeFamily(out, "monitor_latency_percentile_ms", "Estimated percentiles of the latest statistical cycle in milliseconds.", "gauge")
+	for _, s := range snapshots {
+		for i := range s.entries {
+			m := &s.entries[i]
+			names := make([]string, 0, len(m.latest.PercentilesUs))
+			for name := range m.latest.PercentilesUs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				labels := append(seriesLabels(s.clientName, m), [2]string{"percentile", name})
+				writeSample(out, "monitor_latency_percentile_ms", labels, formatUsAsMs(m.latest.PercentilesUs[name]))
+			}
+		}
+	}
+
+	writeFamily(out, "monitor_alert_state", "1 while the alarm of a rule is raised, 0 once recovered.", "gauge")
+	for _, s := range snapshots {
+		for _, m := range s.alerts {
+			names := make([]string, 0, len(m.states))
+			for name := range m.states {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				state := m.states[name]
+				labels := append(baseLabels(s.clientName, m.name, m.labels), [2]string{"type", state.alertType.String()}, [2]string{"rule", name})
+				value := "0"
+				if state.alerting {
+					value = "1"
+				}
+				writeSample(out, "monitor_alert_state", labels, value)
+			}
+		}
+	}
+}
+
+func seriesLabels(clientName string, m *entryMetrics) [][2]string {
+	return baseLabels(clientName, m.name, m.labels)
+}
+
+// The client and interface labels followed by the reported labels, sorted by name. Reported label
+// names are sanitized, and prefixed when they clash with a label set by the handler. A repeated label
+// name fails the whole scrape: the names that are already taken get a numbered suffix, in the order of
+// the reported names
+func baseLabels(clientName string, interfaceName string, labels map[string]string) [][2]string {
+	pairs := make([][2]string, 0, len(labels)+3)
+	pairs = append(pairs, [2]string{"client", clientName}, [2]string{"interface", interfaceName})
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	taken := make(map[string]bool, len(names))
+	for _, name := range names {
+		labelName := prometheusName(name)
+		switch labelName {
+		case "client", "interface", "code", "le", "type", "rule", "percentile":
+			labelName = "label_" + labelName
+		}
+		unique := labelName
+		for i := 2; taken[unique]; i++ {
+			unique = labelName + "_" + strconv.Itoa(i)
+		}
+		taken[unique] = true
+		pairs = append(pairs, [2]string{unique, labels[name]})
+	}
+	return pairs
+}
+
+func writeFamily(out *bufio.Writer, name string, help string, metricType string) {
+	out.WriteString("# HELP " + name + " " + help + "\n# TYPE " + name + " " + metricType + "\n")
+}
+
+func writeSample(out *bufio.Writer, name string, labels [][2]string, value string) {
+	out.WriteString(name)
+	if len(labels) > 0 {
+		out.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			out.WriteString(label[0] + "=\"" + prometheusLabelValueReplacer.Replace(label[1]) + "\"")
+		}
+		out.WriteByte('}')
+	}
+	out.WriteString(" " + value + "\n")
+}
+
+var prometheusLabelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Label names may only contain [a-zA-Z0-9_] and must not start with a digit
+func prometheusName(name string) string {
+	var sanitized strings.Builder
+	for i, r := range name {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9') {
+			sanitized.WriteRune(r)
+		} else {
+			sanitized.WriteByte('_')
+		}
+	}
+	return sanitized.String()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Microseconds as a decimal number of milliseconds, the unit of the latency families: 1500 is "1.5"
+func formatUsAsMs(us uint64) string {
+	return strconv.FormatFloat(float64(us)/usPerMs, 'f', -1, 64)
+}
@@ -0,0 +1,35 @@
+package monitor_tool
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPrometheusLabelCollisions(t *testing.T) {
+	for _, c := range []struct {
+		labels map[string]string
+		want   [][2]string
+	}{
+		{
+			map[string]string{"a-b": "x", "a.b": "y", "a_b": "z"},
+			[][2]string{{"a_b", "x"}, {"a_b_2", "y"}, {"a_b_3", "z"}},
+		},
+		{
+			map[string]string{"client": "x", "label_client": "y"},
+			[][2]string{{"label_client", "x"}, {"label_client_2", "y"}},
+		},
+		{
+			map[string]string{"a_b": "x", "a_b_2": "y", "a-b": "z"},
+			[][2]string{{"a_b", "z"}, {"a_b_2", "x"}, {"a_b_2_2", "y"}},
+		},
+		{
+			map[string]string{"1st": "x", "zone": "y"},
+			[][2]string{{"_st", "x"}, {"zone", "y"}},
+		},
+	} {
+		want := append([][2]string{{"client", "client"}, {"interface", "entry"}}, c.want...)
+		if got := baseLabels("client", "entry", c.labels); !reflect.DeepEqual(got, want) {
+			t.Errorf("labels %v gave %v, want %v", c.labels, got, want)
+		}
+	}
+}
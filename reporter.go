@@ -1,22 +1,45 @@
 package monitor_tool
 
-import "time"
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
 
-// Data carried by the Quality of Service Statistics task (currently not considering reporting time)
+// Prefix of the keys of alert groups in collectDataMap, it keeps them apart from the keys of reported series
+const alertGroupKeyPrefix = "\x00alert"
+
+// Data carried by the Quality of Service Statistics task
 type reportServer struct {
 	// Naming, which should ensure uniqueness.
 	// It can be set as a combination of access address and request method when used in interface reporting.
 	// Some interfaces may carry path parameters or request parameters, if not handled,
 	//the monitoring results will not be as expected,
 	//it is recommended to remove the request parameters and format the path parameters in advance.
-	Name string
-	Ms   uint32
+	Name   string
+	Labels map[string]string
+	// Elapsed time in microseconds
+	Us   uint64
 	Code int
+	// Event time of a report made with ReportAt, zero for the reports counted in the cycle open
+	//when they are collected
+	Time time.Time
 }
 
+// Microseconds in a millisecond, the unit of Report
+const usPerMs = 1000
+
+// The elapsed time of a report is capped to the largest one Report can carry, about 49 days
+const maxReportUs = math.MaxUint32 * usPerMs
+
+// Closes the statistical cycle of every entry
 type clearData struct {
-	Name string
 	Time time.Time
+	// The last flush on shutdown, entries are no longer evicted
+	final bool
 }
 
 // Task queues, aggregating reads and writes
@@ -37,16 +60,197 @@ type taskQueue struct {
 //(locks are occupied), so the analysis process can be light enough to cause reporting to affect the
 //progress of the main process
 // The data for the report can come from anywhere, including interface reporting, service inlining, etc.
-func (c *ReportClientConfig) Report(name string, ms uint32, code int) {
-	if c.taskChannel == nil {
-		panic("Please first register this report type")
-	}
-	c.taskChannel <- &taskQueue{
-		taskType: SERVER,
-		data: reportServer{
+// When the task channel is full, ReportClientConfig.OverflowPolicy decides whether to wait or to drop,
+//a dropped report returns ErrReportDropped and is counted in OutPutData.DroppedCount
+// After the client has been closed, ErrClientClosed is returned and nothing is recorded
+// The name goes through ReportClientConfig.NameNormalizer and MaxNames first
+func (c *ReportClientConfig) Report(name string, ms uint32, code int) error {
+	return c.reportUs(name, nil, uint64(ms)*usPerMs, code, c.OverflowPolicy)
+}
+
+// ReportWithLabels Same as Report, with dimensional labels such as region, method or upstream.
+// Every distinct label set of a name is counted and output as its own series, while alerts follow
+// ReportClientConfig.AlertLabels. The labels map is copied, the caller may reuse it
+func (c *ReportClientConfig) ReportWithLabels(name string, labels map[string]string, ms uint32, code int) error {
+	return c.reportUs(name, labels, uint64(ms)*usPerMs, code, c.OverflowPolicy)
+}
+
+// TryReport Same as Report, but never blocks whatever the OverflowPolicy: false is returned when
+// the report was dropped because the task channel is full, or when the client is closed
+func (c *ReportClientConfig) TryReport(name string, ms uint32, code int) bool {
+	return c.reportUs(name, nil, uint64(ms)*usPerMs, code, DROP_NEWEST) == nil
+}
+
+// ReportDuration Same as Report with the elapsed time as a time.Duration, kept to the microsecond:
+// calls faster than a millisecond are not counted as 0, see OutPutData.MinUs and the other Us fields
+func (c *ReportClientConfig) ReportDuration(name string, d time.Duration, code int) error {
+	return c.reportUs(name, nil, durationUs(d), code, c.OverflowPolicy)
+}
+
+// ReportDurationWithLabels Same as ReportWithLabels with the elapsed time as a time.Duration
+func (c *ReportClientConfig) ReportDurationWithLabels(name string, labels map[string]string, d time.Duration, code int) error {
+	return c.reportUs(name, labels, durationUs(d), code, c.OverflowPolicy)
+}
+
+func (c *ReportClientConfig) reportUs(name string, labels map[string]string, us uint64, code int, policy OverflowPolicy) error {
+	name = c.reportName(name)
+	if len(labels) == 0 {
+		if c.sharded != nil {
+			return c.shardedReport(name, us, code, policy)
+		}
+		return c.report(reportServer{
 			Code: code,
-			Ms:   ms,
+			Us:   us,
 			Name: name,
-		},
+		}, policy)
+	}
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return c.report(reportServer{
+		Code:   code,
+		Us:     us,
+		Name:   name,
+		Labels: copied,
+	}, policy)
+}
+
+// Microseconds rounded to the nearest, negative durations count as 0
+func durationUs(d time.Duration) uint64 {
+	if d <= 0 {
+		return 0
+	}
+	if d >= maxReportUs*time.Microsecond {
+		return maxReportUs
+	}
+	return uint64((d + time.Microsecond/2) / time.Microsecond)
+}
+
+// Dropped Number of reports dropped by the overflow policy since registration
+func (c *ReportClientConfig) Dropped() uint64 {
+	if c.counters == nil {
+		return 0
+	}
+	return c.counters.dropped.Load()
+}
+
+func (c *ReportClientConfig) report(data reportServer, policy OverflowPolicy) error {
+	return c.send(&taskQueue{
+		taskType: SERVER,
+		data:     data,
+	}, policy)
+}
+
+// Queue a reporting task according to the overflow policy, a dropped task counts all its calls
+func (c *ReportClientConfig) send(task *taskQueue, policy OverflowPolicy) error {
+	if c.taskChannel == nil {
+		return ErrNotRegistered
+	}
+	if !c.shutdown.enter() {
+		return ErrClientClosed
+	}
+	defer c.shutdown.leave()
+	switch policy {
+	case BLOCK:
+		// A report blocked on a full channel gives up when the client is closed
+		select {
+		case c.taskChannel <- task:
+			return nil
+		case <-c.stopChannel:
+			return ErrClientClosed
+		}
+	case DROP_OLDEST:
+		for {
+			select {
+			case c.taskChannel <- task:
+				return nil
+			default:
+			}
+			// Make room by discarding the report that has been waiting the longest
+			select {
+			case oldest := <-c.taskChannel:
+				c.counters.drop(oldest.calls())
+			default:
+			}
+		}
+	case SAMPLE:
+		// Under pressure, only one report out of OverflowSampleRate is let through. A channel of a single
+		// task is under pressure once it holds it, not always
+		pressure := cap(c.taskChannel) / 2
+		if pressure < 1 {
+			pressure = 1
+		}
+		if len(c.taskChannel) >= pressure && c.counters.sampled.Add(1)%uint64(c.OverflowSampleRate) != 0 {
+			c.counters.drop(task.calls())
+			return ErrReportDropped
+		}
+	}
+	select {
+	case c.taskChannel <- task:
+		return nil
+	default:
+		c.counters.drop(task.calls())
+		return ErrReportDropped
+	}
+}
+
+// Counters updated by reporting goroutines, shared through a pointer since the configuration is copied
+type clientCounters struct {
+	// Dropped reports since registration, and since the last statistical cycle
+	dropped       atomic.Uint64
+	periodDropped atomic.Uint64
+	// Reports seen under pressure by the SAMPLE policy
+	sampled atomic.Uint64
+	// Entries evicted for being idle
+	evicted atomic.Uint64
+	// Events dropped for arriving after the allowed lateness
+	late atomic.Uint64
+	// Copy of the watermark of the collector in unix nanoseconds, for ReportAt to drop late events early
+	watermark atomic.Int64
+}
+
+func (n *clientCounters) drop(calls uint64) {
+	n.dropped.Add(calls)
+	n.periodDropped.Add(calls)
+}
+
+// Canonical key of a name and its label set, labels are sorted so that the same set always
+// produces the same key. A name without labels is its own key
+func labelKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var key strings.Builder
+	key.WriteString(name)
+	key.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			key.WriteByte(',')
+		}
+		key.WriteString(k)
+		key.WriteByte('=')
+		key.WriteString(strconv.Quote(labels[k]))
+	}
+	key.WriteByte('}')
+	return key.String()
+}
+
+// The subset of labels whose keys are listed, nil if none of them is present
+func selectLabels(labels map[string]string, keys []string) map[string]string {
+	var selected map[string]string
+	for _, k := range keys {
+		if v, ok := labels[k]; ok {
+			if selected == nil {
+				selected = map[string]string{}
+			}
+			selected[k] = v
+		}
 	}
+	return selected
 }
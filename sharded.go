@@ -0,0 +1,300 @@
+package monitor_tool
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of distinct failure codes a shard counts by itself, the reports of further codes go through the
+// task channel
+const shardFailCodes = 8
+
+// A failure code slot that has not been claimed yet
+const emptyFailCode = math.MinInt64
+
+// The minimum of a shard without any success, above any elapsed time
+const emptyMinUs = math.MaxUint64
+
+// Number of sketch counters a shard allocates at once, about a factor 3.6 of elapsed times at the default
+// accuracy: the reports of an entry usually need a couple of blocks out of the 23 that cover every elapsed time
+const sketchBlockSize = 64
+
+type sketchBlock [sketchBlockSize]atomic.Uint64
+
+// shardedCollector Lock-free collection path of Report, see ReportClientConfig.CollectorShards.
+// Reporting goroutines count straight into the atomic counters of a shard of the entry, picked at random,
+// and the collector merges the shards into collectDataMap when it closes the cycle: a report neither
+// allocates nor goes through the task channel
+type shardedCollector struct {
+	// Copy on write, reports load the map without locking and new entries are added under lock
+	entries atomic.Pointer[map[string]*shardedEntry]
+	lock    sync.Mutex
+	// The number of shards is a power of two, minus one it masks a random number into a shard
+	mask uint32
+	// Entries of evicted names, drained once more by the next merge in case a report loaded one of them
+	//just before it was removed. Only used by the collector
+	retired []*shardedEntry
+}
+
+type shardedEntry struct {
+	name   string
+	config *EntryConfig
+	// Bucket layout of the sketch counters of the shards, nil when percentiles are disabled
+	sketch *quantileSketch
+	shards []entryShard
+}
+
+// entryShard Counters of a shard, only ever updated atomically.
+// They are swapped one at a time when merged, so a report made meanwhile may be split over two
+// consecutive cycles, it is never lost
+type entryShard struct {
+	successUsCount atomic.Uint64
+	maxUs          atomic.Uint64
+	// emptyMinUs until a success is recorded
+	minUs        atomic.Uint64
+	successCount atomic.Uint32
+	fastCount    atomic.Uint32
+	failCodes    [shardFailCodes]struct {
+		code  atomic.Int64
+		count atomic.Uint32
+	}
+	distribution []atomic.Uint32
+	// Same layout as quantileSketch by blocks of counters, allocated the first time a report needs them
+	zeroCount    atomic.Uint64
+	sketchBlocks []atomic.Pointer[sketchBlock]
+	// Keeps the counters of neighbouring shards off the same cache line
+	_ [64]byte
+}
+
+func newShardedCollector(shards int) *shardedCollector {
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+	s := &shardedCollector{mask: uint32(n - 1)}
+	s.entries.Store(&map[string]*shardedEntry{})
+	return s
+}
+
+func (c *ReportClientConfig) shardedReport(name string, us uint64, code int, policy OverflowPolicy) error {
+	if !c.shutdown.enter() {
+		return ErrClientClosed
+	}
+	entry := c.getShardedEntry(name)
+	recorded := entry.shards[rand.Uint32()&c.sharded.mask].record(entry, us, code, c.codeSuccess(code))
+	// Left before falling back, report counts itself again
+	c.shutdown.leave()
+	if recorded {
+		return nil
+	}
+	return c.report(reportServer{
+		Code: code,
+		Us:   us,
+		Name: name,
+	}, policy)
+}
+
+func (c *ReportClientConfig) getShardedEntry(name string) *shardedEntry {
+	if entry, ok := (*c.sharded.entries.Load())[name]; ok {
+		return entry
+	}
+	c.sharded.lock.Lock()
+	defer c.sharded.lock.Unlock()
+	entries := *c.sharded.entries.Load()
+	if entry, ok := entries[name]; ok {
+		return entry
+	}
+	// Beyond MaxEntries, the reports of new names are counted in the overflow entry
+	if c.MaxEntries > 0 && len(entries) >= c.MaxEntries {
+		name = c.OtherName
+		if entry, ok := entries[name]; ok {
+			return entry
+		}
+	}
+	entry := &shardedEntry{
+		name:   name,
+		config: c.getEntryConfig(name),
+		shards: make([]entryShard, c.sharded.mask+1),
+	}
+	if !entry.config.DisablePercentiles {
+		entry.sketch = newQuantileSketch(entry.config.PercentileAccuracy)
+	}
+	for i := range entry.shards {
+		shard := &entry.shards[i]
+		shard.distribution = make([]atomic.Uint32, len(entry.config.bucketLabels))
+		if entry.sketch != nil {
+			shard.sketchBlocks = make([]atomic.Pointer[sketchBlock], entry.sketch.index(maxReportUs)/sketchBlockSize+1)
+		}
+		shard.minUs.Store(emptyMinUs)
+		for j := range shard.failCodes {
+			shard.failCodes[j].code.Store(emptyFailCode)
+		}
+	}
+	copied := make(map[string]*shardedEntry, len(entries)+1)
+	for k, v := range entries {
+		copied[k] = v
+	}
+	copied[name] = entry
+	c.sharded.entries.Store(&copied)
+	return entry
+}
+
+// Same counting as record, false when the failure code found no free slot
+func (s *entryShard) record(entry *shardedEntry, us uint64, code int, success bool) bool {
+	if !success {
+		for i := range s.failCodes {
+			slot := &s.failCodes[i]
+			if slot.code.Load() == emptyFailCode {
+				slot.code.CompareAndSwap(emptyFailCode, int64(code))
+			}
+			if slot.code.Load() == int64(code) {
+				slot.count.Add(1)
+				return true
+			}
+		}
+		return false
+	}
+	s.successCount.Add(1)
+	s.successUsCount.Add(us)
+	for {
+		current := s.minUs.Load()
+		if us >= current || s.minUs.CompareAndSwap(current, us) {
+			break
+		}
+	}
+	for {
+		current := s.maxUs.Load()
+		if us <= current || s.maxUs.CompareAndSwap(current, us) {
+			break
+		}
+	}
+	s.distribution[entry.config.bucketIndex(us)].Add(1)
+	if entry.sketch != nil {
+		if us < 1 {
+			s.zeroCount.Add(1)
+		} else {
+			index := entry.sketch.index(us)
+			s.sketchBlock(index / sketchBlockSize)[index%sketchBlockSize].Add(1)
+		}
+	}
+	if us <= entry.config.fastLessThanUs {
+		s.fastCount.Add(1)
+	}
+	return true
+}
+
+// The block of sketch counters, allocated by the first report that needs it
+func (s *entryShard) sketchBlock(b int) *sketchBlock {
+	if block := s.sketchBlocks[b].Load(); block != nil {
+		return block
+	}
+	// Concurrent reports may both allocate it, only one block is kept
+	s.sketchBlocks[b].CompareAndSwap(nil, new(sketchBlock))
+	return s.sketchBlocks[b].Load()
+}
+
+// Move the counts of the shards of every entry into collectDataMap, called by the collector
+// right before it closes the cycle
+func (c *ReportClientConfig) mergeShards() {
+	if c.sharded == nil {
+		return
+	}
+	for _, entry := range *c.sharded.entries.Load() {
+		c.mergeShardedEntry(entry)
+	}
+	for _, entry := range c.sharded.retired {
+		c.mergeShardedEntry(entry)
+	}
+	c.sharded.retired = nil
+}
+
+func (c *ReportClientConfig) mergeShardedEntry(entry *shardedEntry) {
+	merged := reportData{
+		Config:                    entry.config,
+		FailDistribution:          map[int]uint32{},
+		TimeConsumingDistribution: make([]uint32, len(entry.config.bucketLabels)),
+	}
+	if entry.sketch != nil {
+		merged.sketch = newQuantileSketch(entry.config.PercentileAccuracy)
+	}
+	for i := range entry.shards {
+		entry.shards[i].drain(&merged)
+	}
+	if merged.SuccessCount == 0 && merged.FailCount == 0 {
+		return
+	}
+	if c.AlertLabels == nil {
+		c.getCollectData(c.collectDataMap, entry.name, entry.name, nil).merge(&merged)
+		return
+	}
+	seriesData := c.getCollectData(c.collectDataMap, entry.name, entry.name, nil)
+	seriesData.skipAlert = true
+	seriesData.merge(&merged)
+	groupData := c.getCollectData(c.collectDataMap, alertGroupKeyPrefix+entry.name, entry.name, nil)
+	groupData.skipOutput = true
+	groupData.merge(&merged)
+}
+
+// Remove the entry of an evicted name, called by the collector
+func (c *ReportClientConfig) retireShardedEntry(name string) {
+	c.sharded.lock.Lock()
+	defer c.sharded.lock.Unlock()
+	entries := *c.sharded.entries.Load()
+	entry, ok := entries[name]
+	if !ok {
+		return
+	}
+	copied := make(map[string]*shardedEntry, len(entries))
+	for k, v := range entries {
+		if k != name {
+			copied[k] = v
+		}
+	}
+	c.sharded.entries.Store(&copied)
+	c.sharded.retired = append(c.sharded.retired, entry)
+}
+
+func (s *entryShard) drain(d *reportData) {
+	minUs, maxUs := s.minUs.Swap(emptyMinUs), s.maxUs.Swap(0)
+	// A success recorded meanwhile may be counted before its elapsed time is, its range then goes
+	//to the next cycle
+	if minUs != emptyMinUs {
+		d.setMinMax(minUs, maxUs)
+	}
+	d.SuccessCount += s.successCount.Swap(0)
+	d.FastCount += s.fastCount.Swap(0)
+	d.SuccessUsCount += s.successUsCount.Swap(0)
+	for i := range s.distribution {
+		d.TimeConsumingDistribution[i] += s.distribution[i].Swap(0)
+	}
+	for i := range s.failCodes {
+		if n := s.failCodes[i].count.Swap(0); n > 0 {
+			d.FailCount += n
+			d.FailDistribution[int(s.failCodes[i].code.Load())] += n
+		}
+	}
+	if d.sketch == nil {
+		return
+	}
+	if n := s.zeroCount.Swap(0); n > 0 {
+		d.sketch.zeroCount += n
+		d.sketch.count += n
+	}
+	for b := range s.sketchBlocks {
+		block := s.sketchBlocks[b].Load()
+		if block == nil {
+			continue
+		}
+		for i := range block {
+			// Most counters stay at 0, loading first spares writing to them
+			if block[i].Load() == 0 {
+				continue
+			}
+			n := block[i].Swap(0)
+			d.sketch.addIndex(b*sketchBlockSize+i, n)
+			d.sketch.count += n
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package monitor_tool
+
+import (
+	"context"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func benchmarkClient(b testing.TB, shards int) ReportClient {
+	client, err := NewClient(ReportClientConfig{
+		Name:                 "benchmark",
+		StatisticalCycle:     60000,
+		ChannelCacheCount:    10000,
+		CollectorShards:      shards,
+		DisableDefaultOutput: true,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return client
+}
+
+// The task channel path and the sharded path, from every processor at once
+func BenchmarkReport(b *testing.B) {
+	for _, shards := range []int{0, runtime.GOMAXPROCS(0)} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			client := benchmarkClient(b, shards)
+			defer client.Close(context.Background())
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := uint32(0); pb.Next(); i++ {
+					client.Report("entry", i%500, 200)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkReportFailures(b *testing.B) {
+	for _, shards := range []int{0, runtime.GOMAXPROCS(0)} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			client := benchmarkClient(b, shards)
+			defer client.Close(context.Background())
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					client.Report("entry", 10, 500+i%4)
+				}
+			})
+		})
+	}
+}
+
+func TestShardedReportDoesNotAllocate(t *testing.T) {
+	client := benchmarkClient(t, 4)
+	defer client.Close(context.Background())
+	// The entry is created by the first report
+	client.Report("entry", 10, 200)
+	if allocs := testing.AllocsPerRun(1000, func() { client.Report("entry", 10, 200) }); allocs != 0 {
+		t.Fatalf("%v allocations per sharded report", allocs)
+	}
+}
+
+// The same reports give the same outputs whether they go through the task channel or the shards
+func TestShardedOutputsMatchChannel(t *testing.T) {
+	run := func(shards int) []OutPutData {
+		var lock sync.Mutex
+		var outputs []OutPutData
+		client, err := NewClient(ReportClientConfig{
+			Name:                 "shards-" + strconv.Itoa(shards),
+			StatisticalCycle:     60000,
+			CollectorShards:      shards,
+			DisableDefaultOutput: true,
+			OutputCaller: func(o *OutPutData) {
+				lock.Lock()
+				outputs = append(outputs, *o)
+				lock.Unlock()
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reporters sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			reporters.Add(1)
+			go func(g int) {
+				defer reporters.Done()
+				for i := 0; i < 500; i++ {
+					// Up to 12 failure codes, more than a shard keeps
+					code := 200
+					if i%5 == 0 {
+						code = 500 + i%12
+					}
+					client.Report("entry-"+strconv.Itoa(i%3), 1+uint32(i*g%700), code)
+				}
+			}(g)
+		}
+		reporters.Wait()
+		if err := client.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(outputs, func(i, j int) bool { return outputs[i].InterfaceName < outputs[j].InterfaceName })
+		for i := range outputs {
+			outputs[i].ClientName = ""
+			outputs[i].Timestamp = time.Time{}
+		}
+		return outputs
+	}
+	channel, sharded := run(0), run(4)
+	if len(channel) != 3 {
+		t.Fatalf("%d outputs, want 3", len(channel))
+	}
+	if !reflect.DeepEqual(channel, sharded) {
+		t.Fatalf("the task channel gave\n%+v\nthe shards gave\n%+v", channel, sharded)
+	}
+}
+
+func TestShardSketchBlocksAreAllocatedLazily(t *testing.T) {
+	c, err := newClient(ReportClientConfig{
+		Name:                 "blocks",
+		StatisticalCycle:     60000,
+		CollectorShards:      64,
+		DisableDefaultOutput: true,
+	}, &configChecker{strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(context.Background())
+	for i := 0; i < 10000; i++ {
+		c.Report("entry", 10, 200)
+	}
+	entry := (*c.sharded.entries.Load())["entry"]
+	for i := range entry.shards {
+		allocated := 0
+		for b := range entry.shards[i].sketchBlocks {
+			if entry.shards[i].sketchBlocks[b].Load() != nil {
+				allocated++
+			}
+		}
+		if allocated > 1 {
+			t.Fatalf("shard %d allocated %d blocks of sketch counters for a single elapsed time", i, allocated)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package monitor_tool
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileFormat Line format written by a FileSink
+type FileFormat uint8
+
+const (
+	// NDJSON One JSON object per line, the same encoding as the default output
+	NDJSON FileFormat = iota
+	// CSV Comma separated values with a header line, the distributions are JSON encoded cells
+	CSV
+)
+
+// Suffix layout of rotated files, sorting the names sorts the files by age
+const rotatedFileTimeLayout = "20060102T150405.000000000"
+
+var csvHeader = []string{
+	"timestamp", "clientName", "interfaceName", "labels", "count", "successCount", "successRate", "successMsAver",
+	"maxMs", "minMs", "fastCount", "fastRate", "failCount", "failDistribution", "timeConsumingDistribution", "percentiles",
+}
+
+// FileSinkConfig Configuration of a FileSink
+type FileSinkConfig struct {
+	// Path of the active file. Rotated files are renamed to Path.<time>, plus .gz when compressed
+	Path   string
+	Format FileFormat
+	// Rotate before the active file would grow beyond this size in bytes, 0 disables size rotation
+	MaxSize int64
+	// Rotate when the active file has been open for this long, 0 disables time rotation
+	RotateInterval time.Duration
+	// Number of rotated files kept, the oldest ones are removed. 0 keeps all of them
+	MaxBackups int
+	// Gzip rotated files
+	Compress bool
+}
+
+// FileSink Writes one OutPutData per line to a file that rotates by size and by time.
+// Its Output can be the OutputCaller of a client, with DisableDefaultOutput to keep stdout clean: the writes
+// are serialized, and the rotated files are compressed and pruned in the background
+type FileSink struct {
+	config FileSinkConfig
+	lock   sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	// Rotated files are compressed and pruned in the background, one rotation at a time
+	backgroundLock sync.Mutex
+	background     sync.WaitGroup
+}
+
+func NewFileSink(config FileSinkConfig) (*FileSink, error) {
+	if config.Path == "" {
+		return nil, errors.New("the path of the file sink must not be empty")
+	}
+	if config.Format != NDJSON && config.Format != CSV {
+		return nil, errors.New("unknown file format " + strconv.Itoa(int(config.Format)))
+	}
+	s := &FileSink{config: config}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Output Write the data, errors go to stderr as for the default output
+func (s *FileSink) Output(o *OutPutData) {
+	if err := s.WriteOutput(o); err != nil {
+		os.Stderr.WriteString("file sink: " + err.Error() + "\n")
+	}
+}
+
+// WriteOutput Write the data as one line, rotating the file first when needed
+func (s *FileSink) WriteOutput(o *OutPutData) error {
+	line, err := s.encode(o)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return errors.New("the file sink has been closed")
+	}
+	if s.size > 0 && s.shouldRotate(int64(len(line))) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if s.size == 0 && s.config.Format == CSV {
+		header, _ := encodeCSV(csvHeader)
+		line = append(header, line...)
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// Close Sync and close the active file, and wait for the background compression
+func (s *FileSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return errors.New("the file sink has been closed")
+	}
+	err := s.file.Sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file = nil
+	s.background.Wait()
+	return err
+}
+
+func (s *FileSink) shouldRotate(next int64) bool {
+	if s.config.MaxSize > 0 && s.size+next > s.config.MaxSize {
+		return true
+	}
+	return s.config.RotateInterval > 0 && time.Since(s.opened) >= s.config.RotateInterval
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	s.opened = time.Now()
+	return nil
+}
+
+// The active file is synced before it is renamed, so a rotated file is always complete on disk
+func (s *FileSink) rotate() error {
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	rotated := s.config.Path + "." + time.Now().UTC().Format(rotatedFileTimeLayout)
+	if err := os.Rename(s.config.Path, rotated); err != nil {
+		// Keep writing to the same file rather than losing data
+		if openErr := s.open(); openErr != nil {
+			s.file = nil
+		}
+		return err
+	}
+	if err := s.open(); err != nil {
+		s.file = nil
+		return err
+	}
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.backgroundLock.Lock()
+		defer s.backgroundLock.Unlock()
+		if s.config.Compress {
+			if err := compressFile(rotated); err != nil {
+				os.Stderr.WriteString("file sink: " + err.Error() + "\n")
+			}
+		}
+		s.prune()
+	}()
+	return nil
+}
+
+// Remove the oldest rotated files beyond MaxBackups
+func (s *FileSink) prune() {
+	if s.config.MaxBackups <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(s.config.Path + ".*")
+	if err != nil {
+		return
+	}
+	rotated := matches[:0]
+	for _, match := range matches {
+		// Only the files named by rotate, leftovers of an interrupted compression are not backups
+		suffix := strings.TrimPrefix(match, s.config.Path+".")
+		if suffix != "" && suffix[0] >= '0' && suffix[0] <= '9' && !strings.HasSuffix(match, ".tmp") {
+			rotated = append(rotated, match)
+		}
+	}
+	sort.Strings(rotated)
+	for i := 0; i < len(rotated)-s.config.MaxBackups; i++ {
+		os.Remove(rotated[i])
+	}
+}
+
+func compressFile(path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := os.OpenFile(path+".gz.tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(target)
+	_, err = io.Copy(writer, source)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = target.Sync()
+	}
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".gz.tmp", path+".gz")
+	}
+	if err != nil {
+		os.Remove(path + ".gz.tmp")
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (s *FileSink) encode(o *OutPutData) ([]byte, error) {
+	if s.config.Format == NDJSON {
+		b, err := json.Marshal(*o)
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	}
+	failDistribution, err := json.Marshal(o.FailDistribution)
+	if err != nil {
+		return nil, err
+	}
+	timeConsumingDistribution, err := json.Marshal(o.TimeConsumingDistribution)
+	if err != nil {
+		return nil, err
+	}
+	percentiles, err := json.Marshal(o.Percentiles)
+	if err != nil {
+		return nil, err
+	}
+	labels := make([]string, 0, len(o.Labels))
+	for _, k := range sortedLabelKeys(o.Labels) {
+		labels = append(labels, k+"="+o.Labels[k])
+	}
+	return encodeCSV([]string{
+		o.Timestamp.Format(time.RFC3339Nano),
+		o.ClientName,
+		o.InterfaceName,
+		strings.Join(labels, ";"),
+		strconv.FormatUint(uint64(o.Count), 10),
+		strconv.FormatUint(uint64(o.SuccessCount), 10),
+		strconv.FormatFloat(o.SuccessRate, 'f', -1, 64),
+		strconv.FormatUint(uint64(o.SuccessMsAver), 10),
+		strconv.FormatUint(uint64(o.MaxMs), 10),
+		strconv.FormatUint(uint64(o.MinMs), 10),
+		strconv.FormatUint(uint64(o.FastCount), 10),
+		strconv.FormatFloat(o.FastRate, 'f', -1, 64),
+		strconv.FormatUint(uint64(o.FailCount), 10),
+		string(failDistribution),
+		string(timeConsumingDistribution),
+		string(percentiles),
+	})
+}
+
+func encodeCSV(record []string) ([]byte, error) {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	if err := w.Write(record); err != nil {
+		return nil, err
+	}
+	w.Flush()
+	return []byte(b.String()), w.Error()
+}
@@ -0,0 +1,161 @@
+package monitor_tool
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write one output per name and close the sink
+func writeOutputs(t *testing.T, config FileSinkConfig, names ...string) {
+	t.Helper()
+	sink, err := NewFileSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if err := sink.WriteOutput(&OutPutData{ClientName: "sink", InterfaceName: name, Count: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The rotated files from the oldest to the newest, then the active file
+func sinkFiles(t *testing.T, path string) []string {
+	t.Helper()
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(rotated)
+	return append(rotated, path)
+}
+
+func readSinkFile(t *testing.T, path string) string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		if r, err = gzip.NewReader(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// The interface names of the NDJSON lines of a file
+func ndjsonNames(t *testing.T, content string) []string {
+	t.Helper()
+	var names []string
+	for _, line := range strings.Split(strings.TrimSuffix(content, "\n"), "\n") {
+		var o OutPutData
+		if err := json.Unmarshal([]byte(line), &o); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		names = append(names, o.InterfaceName)
+	}
+	return names
+}
+
+func TestFileSinkRotatesBySizeWithACSVHeaderPerFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outputs.csv")
+	// Every line after the first one of a file goes beyond the size
+	writeOutputs(t, FileSinkConfig{Path: path, Format: CSV, MaxSize: 1}, "a", "b", "c")
+	files := sinkFiles(t, path)
+	if len(files) != 3 {
+		t.Fatalf("files %v, want 2 rotated files and the active one", files)
+	}
+	for i, file := range files {
+		records, err := csv.NewReader(strings.NewReader(readSinkFile(t, file))).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 2 || !reflect.DeepEqual(records[0], csvHeader) || records[1][2] != string(rune('a'+i)) {
+			t.Fatalf("%s holds %v, want the header and the output of %c", file, records, 'a'+i)
+		}
+	}
+}
+
+func TestFileSinkRotatesByTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outputs.ndjson")
+	sink, err := NewFileSink(FileSinkConfig{Path: path, RotateInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := sink.WriteOutput(&OutPutData{InterfaceName: name}); err != nil {
+			t.Fatal(err)
+		}
+		if name == "b" {
+			time.Sleep(30 * time.Millisecond)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files := sinkFiles(t, path)
+	if len(files) != 2 {
+		t.Fatalf("files %v, want 1 rotated file and the active one", files)
+	}
+	if names := ndjsonNames(t, readSinkFile(t, files[0])); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Fatalf("the rotated file holds %v, want a and b", names)
+	}
+	if names := ndjsonNames(t, readSinkFile(t, files[1])); !reflect.DeepEqual(names, []string{"c"}) {
+		t.Fatalf("the active file holds %v, want c", names)
+	}
+}
+
+func TestFileSinkCompressesRotatedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outputs.ndjson")
+	writeOutputs(t, FileSinkConfig{Path: path, MaxSize: 1, Compress: true}, "a", "b", "c")
+	files := sinkFiles(t, path)
+	if len(files) != 3 {
+		t.Fatalf("files %v, want 2 rotated files and the active one", files)
+	}
+	for i, file := range files {
+		if rotated := i < len(files)-1; rotated != strings.HasSuffix(file, ".gz") {
+			t.Fatalf("%s: only the rotated files are compressed", file)
+		}
+		if names := ndjsonNames(t, readSinkFile(t, file)); !reflect.DeepEqual(names, []string{string(rune('a' + i))}) {
+			t.Fatalf("%s holds %v, want %c", file, names, 'a'+i)
+		}
+	}
+}
+
+func TestFileSinkKeepsTheNewestBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outputs.ndjson")
+	names := make([]string, 6)
+	for i := range names {
+		names[i] = "entry-" + strconv.Itoa(i)
+	}
+	writeOutputs(t, FileSinkConfig{Path: path, MaxSize: 1, MaxBackups: 2}, names...)
+	files := sinkFiles(t, path)
+	if len(files) != 3 {
+		t.Fatalf("files %v, want 2 rotated files and the active one", files)
+	}
+	for i, file := range files {
+		if got := ndjsonNames(t, readSinkFile(t, file)); !reflect.DeepEqual(got, names[3+i:4+i]) {
+			t.Fatalf("%s holds %v, want %v", file, got, names[3+i:4+i])
+		}
+	}
+}
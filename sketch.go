@@ -0,0 +1,102 @@
+package monitor_tool
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// quantileSketch Logarithmic bucket sketch in the manner of DDSketch. A value v >= 1 is counted in bucket
+// ceil(log(v)/log(gamma)) with gamma = (1+accuracy)/(1-accuracy), so any quantile is estimated with a
+// relative error of at most accuracy. Since values are bounded integers, the number of buckets is bounded
+// as well: about log(max value)/log(gamma), that is ~1100 counters for uint32 values at 1%
+type quantileSketch struct {
+	gamma    float64
+	logGamma float64
+	// Values below 1 (0 in practice) cannot be mapped onto the logarithmic scale
+	zeroCount uint64
+	// Counters indexed by bucket, the slice only grows up to the highest bucket seen
+	counts []uint64
+	count  uint64
+}
+
+func newQuantileSketch(accuracy float64) *quantileSketch {
+	gamma := (1 + accuracy) / (1 - accuracy)
+	return &quantileSketch{
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+	}
+}
+
+func (s *quantileSketch) add(v uint64, n uint64) {
+	if n == 0 {
+		return
+	}
+	s.count += n
+	if v < 1 {
+		s.zeroCount += n
+		return
+	}
+	s.addIndex(s.index(v), n)
+}
+
+// Bucket of a value v >= 1
+func (s *quantileSketch) index(v uint64) int {
+	return int(math.Ceil(math.Log(float64(v)) / s.logGamma))
+}
+
+// Count n values directly into a bucket, count is left to the caller
+func (s *quantileSketch) addIndex(index int, n uint64) {
+	if index >= len(s.counts) {
+		s.counts = append(s.counts, make([]uint64, index+1-len(s.counts))...)
+	}
+	s.counts[index] += n
+}
+
+// Merge another sketch, built with another accuracy its buckets are added at their estimated value
+func (s *quantileSketch) merge(o *quantileSketch) {
+	if o == nil || o.count == 0 {
+		return
+	}
+	if o.gamma != s.gamma {
+		s.add(0, o.zeroCount)
+		for i, n := range o.counts {
+			s.add(uint64(math.Round(2*math.Pow(o.gamma, float64(i))/(o.gamma+1))), n)
+		}
+		return
+	}
+	s.count += o.count
+	s.zeroCount += o.zeroCount
+	if len(o.counts) > len(s.counts) {
+		s.counts = append(s.counts, make([]uint64, len(o.counts)-len(s.counts))...)
+	}
+	for i, n := range o.counts {
+		s.counts[i] += n
+	}
+}
+
+// Estimated value at quantile q in [0, 1], 0 for an empty sketch
+func (s *quantileSketch) quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(s.count-1))
+	if rank < s.zeroCount {
+		return 0
+	}
+	cumulative := s.zeroCount
+	for i, n := range s.counts {
+		cumulative += n
+		if cumulative > rank {
+			// The value that minimizes the relative error within (gamma^(i-1), gamma^i]
+			return 2 * math.Pow(s.gamma, float64(i)) / (s.gamma + 1)
+		}
+	}
+	return math.Pow(s.gamma, float64(len(s.counts)-1))
+}
+
+// Name of a quantile in the output, 0.5 -> p50, 0.99 -> p99, 0.999 -> p999
+func percentileName(q float64) string {
+	percent := strconv.FormatFloat(math.Round(q*1e8)/1e6, 'f', -1, 64)
+	return "p" + strings.Replace(percent, ".", "", 1)
+}
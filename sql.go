@@ -0,0 +1,519 @@
+package monitor_tool
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Operations of the database/sql wrappers, the first argument of SQLConfig.Name
+const (
+	SQL_EXEC     = "EXEC"
+	SQL_QUERY    = "QUERY"
+	SQL_PREPARE  = "PREPARE"
+	SQL_BEGIN    = "BEGIN"
+	SQL_COMMIT   = "COMMIT"
+	SQL_ROLLBACK = "ROLLBACK"
+)
+
+// SQLConfig Configuration of NewSQLDriver and NewSQLConnector
+type SQLConfig struct {
+	// Name of the entry of an operation, the default is the operation followed by the SQLFingerprint of the
+	// query, e.g. "QUERY SELECT * FROM users WHERE id = ?". The query is empty for BEGIN, COMMIT and ROLLBACK
+	Name func(operation string, query string) string
+	// Labels of the report of an operation, nil reports without labels. COMMIT and ROLLBACK get the context
+	// of their BEGIN, the operations of the context-less driver methods get context.Background()
+	Labels func(ctx context.Context) map[string]string
+	// Code of the error returned by the driver, nil included (the success), the default is SQLErrorCode
+	ErrorCode func(err error) int
+}
+
+// SQLErrorCode The default SQLConfig.ErrorCode: driver.ErrBadConn is CODE_BAD_CONN, sql.ErrNoRows is
+// CODE_NO_ROWS, the other errors are classified by DefaultErrorClassifier.
+// Drivers never return sql.ErrNoRows, database/sql does from Row.Scan: use SQLErrorCode as ErrorClassifier
+// of the client to report it through Observe
+func SQLErrorCode(err error) int {
+	if errors.Is(err, driver.ErrBadConn) {
+		return CODE_BAD_CONN
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return CODE_NO_ROWS
+	}
+	return DefaultErrorClassifier(err)
+}
+
+var (
+	// A parenthesized list of placeholders, e.g. IN (?, ?, ?)
+	sqlPlaceholderList = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	// Rows of a multi-row insert, e.g. VALUES (?), (?)
+	sqlRepeatedRows = regexp.MustCompile(`\(\?\)(?:\s*,\s*\(\?\))+`)
+)
+
+// SQLFingerprint The query without its literals, so that the queries that only differ by their values share
+// an entry: comments are removed, string and number literals and numbered placeholders ($1) become "?",
+// lists of values collapse into a single "(?)" and whitespace into single spaces.
+// Quoted identifiers ("name" and `name`) are kept
+func SQLFingerprint(query string) string {
+	var b strings.Builder
+	b.Grow(len(query))
+	space := false
+	write := func(token string) {
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteString(token)
+	}
+	for i := 0; i < len(query); {
+		ch := query[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == '\f':
+			space = true
+			i++
+		case ch == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			space = true
+			i += end
+		case ch == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				end = len(query) - i - 2
+			} else {
+				end += 2
+			}
+			space = true
+			i += end + 2
+		case ch == '\'':
+			// A quote is escaped by doubling it
+			i++
+			for i < len(query) {
+				if query[i] == '\'' {
+					if i+1 < len(query) && query[i+1] == '\'' {
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				i++
+			}
+			write("?")
+		case ch == '"' || ch == '`':
+			end := strings.IndexByte(query[i+1:], ch)
+			if end < 0 {
+				end = len(query) - i - 1
+			} else {
+				end++
+			}
+			write(query[i : i+end+1])
+			i += end + 1
+		case isDigit(ch) || (ch == '.' && i+1 < len(query) && isDigit(query[i+1])):
+			for i < len(query) && (isWordByte(query[i]) || query[i] == '.' ||
+				((query[i] == '+' || query[i] == '-') && (query[i-1] == 'e' || query[i-1] == 'E'))) {
+				i++
+			}
+			write("?")
+		case ch == '$' && i+1 < len(query) && isDigit(query[i+1]):
+			for i++; i < len(query) && isDigit(query[i]); i++ {
+			}
+			write("?")
+		case isWordByte(ch):
+			start := i
+			for i < len(query) && (isWordByte(query[i]) || query[i] == '$') {
+				i++
+			}
+			// Prefixed string literals: N'...', E'...', X'...', B'...'
+			if i-start == 1 && i < len(query) && query[i] == '\'' && strings.ContainsRune("NnEeXxBb", rune(ch)) {
+				continue
+			}
+			write(query[start:i])
+		default:
+			write(query[i : i+1])
+			i++
+		}
+	}
+	fingerprint := sqlPlaceholderList.ReplaceAllString(b.String(), "(?)")
+	return sqlRepeatedRows.ReplaceAllString(fingerprint, "(?)")
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func isWordByte(ch byte) bool {
+	return ch == '_' || isDigit(ch) || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || ch >= 0x80
+}
+
+// NewSQLDriver Wraps a database/sql driver to report every Exec, Query, Prepare, Begin, Commit and Rollback
+// to the client, with the code SQLConfig.ErrorCode gives to the error of the driver and the time until the
+// driver returned (reading the rows of a query is not included). Register the wrapped driver under a name
+// of its own:
+//
+//	sql.Register("postgres-monitored", NewSQLDriver(client, &pq.Driver{}, SQLConfig{}))
+//	db, err := sql.Open("postgres-monitored", dsn)
+//
+// The codes of the errors are failures named through CodeFeatureMap, mark 200 as a success when
+// GetCodeFeature is set
+func NewSQLDriver(client ReportClient, base driver.Driver, config SQLConfig) driver.Driver {
+	return &instrumentedDriver{base: base, sql: newSQLReporter(client, config)}
+}
+
+// NewSQLConnector Same as NewSQLDriver for a driver.Connector, to open with sql.OpenDB
+func NewSQLConnector(client ReportClient, base driver.Connector, config SQLConfig) driver.Connector {
+	return newInstrumentedConnector(base, newSQLReporter(client, config))
+}
+
+type sqlReporter struct {
+	client ReportClient
+	config SQLConfig
+}
+
+func newSQLReporter(client ReportClient, config SQLConfig) *sqlReporter {
+	if config.Name == nil {
+		config.Name = func(operation string, query string) string {
+			if query == "" {
+				return operation
+			}
+			return operation + " " + SQLFingerprint(query)
+		}
+	}
+	if config.ErrorCode == nil {
+		config.ErrorCode = SQLErrorCode
+	}
+	return &sqlReporter{client: client, config: config}
+}
+
+func (s *sqlReporter) report(ctx context.Context, operation string, query string, start time.Time, err error) {
+	// database/sql falls back to another method, which is reported instead
+	if err == driver.ErrSkip {
+		return
+	}
+	elapsed := time.Since(start)
+	name := s.config.Name(operation, query)
+	code := s.config.ErrorCode(err)
+	if s.config.Labels != nil {
+		s.client.ReportDurationWithLabels(name, s.config.Labels(ctx), elapsed, code)
+	} else {
+		s.client.ReportDuration(name, elapsed, code)
+	}
+}
+
+type instrumentedDriver struct {
+	base driver.Driver
+	sql  *sqlReporter
+}
+
+func (d *instrumentedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.base.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{base: conn, sql: d.sql}, nil
+}
+
+func (d *instrumentedDriver) OpenConnector(name string) (driver.Connector, error) {
+	if driverContext, ok := d.base.(driver.DriverContext); ok {
+		connector, err := driverContext.OpenConnector(name)
+		if err != nil {
+			return nil, err
+		}
+		return newInstrumentedConnector(connector, d.sql), nil
+	}
+	return &instrumentedConnector{base: dsnConnector{name: name, driver: d.base}, driver: d, sql: d.sql}, nil
+}
+
+// dsnConnector What database/sql uses for the drivers that are not a driver.DriverContext
+type dsnConnector struct {
+	name   string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.name)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type instrumentedConnector struct {
+	base   driver.Connector
+	driver *instrumentedDriver
+	sql    *sqlReporter
+}
+
+func newInstrumentedConnector(base driver.Connector, sql *sqlReporter) *instrumentedConnector {
+	return &instrumentedConnector{base: base, driver: &instrumentedDriver{base: base.Driver(), sql: sql}, sql: sql}
+}
+
+func (c *instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.base.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{base: conn, sql: c.sql}, nil
+}
+
+func (c *instrumentedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// Close Called by DB.Close
+func (c *instrumentedConnector) Close() error {
+	if closer, ok := c.base.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// instrumentedConn Implements every optional interface of a connection, with the behaviour database/sql
+// has when the wrapped connection does not implement it
+type instrumentedConn struct {
+	base driver.Conn
+	sql  *sqlReporter
+}
+
+func (c *instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	start := time.Now()
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.base.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.base.Prepare(query)
+	}
+	c.sql.report(ctx, SQL_PREPARE, query, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return newInstrumentedStmt(stmt, c, query), nil
+}
+
+func (c *instrumentedConn) Close() error {
+	return c.base.Close()
+}
+
+func (c *instrumentedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	start := time.Now()
+	var tx driver.Tx
+	var err error
+	if beginner, ok := c.base.(driver.ConnBeginTx); ok {
+		tx, err = beginner.BeginTx(ctx, opts)
+	} else if opts.Isolation != driver.IsolationLevel(sql.LevelDefault) {
+		return nil, errors.New("sql: driver does not support non-default isolation level")
+	} else if opts.ReadOnly {
+		return nil, errors.New("sql: driver does not support read-only transactions")
+	} else {
+		tx, err = c.base.Begin()
+	}
+	c.sql.report(ctx, SQL_BEGIN, "", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedTx{base: tx, ctx: ctx, sql: c.sql}, nil
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	var result driver.Result
+	var err error
+	if execer, ok := c.base.(driver.ExecerContext); ok {
+		result, err = execer.ExecContext(ctx, query, args)
+	} else if execer, ok := c.base.(driver.Execer); ok {
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err != nil {
+			return nil, err
+		}
+		result, err = execer.Exec(query, values)
+	} else {
+		return nil, driver.ErrSkip
+	}
+	c.sql.report(ctx, SQL_EXEC, query, start, err)
+	return result, err
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if queryer, ok := c.base.(driver.QueryerContext); ok {
+		rows, err = queryer.QueryContext(ctx, query, args)
+	} else if queryer, ok := c.base.(driver.Queryer); ok {
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err != nil {
+			return nil, err
+		}
+		rows, err = queryer.Query(query, values)
+	} else {
+		return nil, driver.ErrSkip
+	}
+	c.sql.report(ctx, SQL_QUERY, query, start, err)
+	return rows, err
+}
+
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.base.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.base.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) IsValid() bool {
+	if validator, ok := c.base.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *instrumentedConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.base.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+type instrumentedStmt struct {
+	base  driver.Stmt
+	conn  *instrumentedConn
+	query string
+}
+
+// instrumentedConverterStmt A statement of a driver that converts its arguments with a
+// driver.ColumnConverter, database/sql only uses the default conversion for the statements
+// that do not implement it
+type instrumentedConverterStmt struct {
+	*instrumentedStmt
+}
+
+func (s instrumentedConverterStmt) ColumnConverter(idx int) driver.ValueConverter {
+	return s.base.(driver.ColumnConverter).ColumnConverter(idx)
+}
+
+func newInstrumentedStmt(base driver.Stmt, conn *instrumentedConn, query string) driver.Stmt {
+	stmt := &instrumentedStmt{base: base, conn: conn, query: query}
+	if _, ok := base.(driver.ColumnConverter); ok {
+		return instrumentedConverterStmt{stmt}
+	}
+	return stmt
+}
+
+func (s *instrumentedStmt) Close() error {
+	return s.base.Close()
+}
+
+func (s *instrumentedStmt) NumInput() int {
+	return s.base.NumInput()
+}
+
+func (s *instrumentedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	start := time.Now()
+	result, err := s.base.Exec(args)
+	s.conn.sql.report(context.Background(), SQL_EXEC, s.query, start, err)
+	return result, err
+}
+
+func (s *instrumentedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.base.Query(args)
+	s.conn.sql.report(context.Background(), SQL_QUERY, s.query, start, err)
+	return rows, err
+}
+
+func (s *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	var result driver.Result
+	var err error
+	if execer, ok := s.base.(driver.StmtExecContext); ok {
+		result, err = execer.ExecContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err != nil {
+			return nil, err
+		}
+		result, err = s.base.Exec(values)
+	}
+	s.conn.sql.report(ctx, SQL_EXEC, s.query, start, err)
+	return result, err
+}
+
+func (s *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if queryer, ok := s.base.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err != nil {
+			return nil, err
+		}
+		rows, err = s.base.Query(values)
+	}
+	s.conn.sql.report(ctx, SQL_QUERY, s.query, start, err)
+	return rows, err
+}
+
+// CheckNamedValue database/sql only asks the connection when the statement is not a
+// driver.NamedValueChecker, which the wrapper always is
+func (s *instrumentedStmt) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := s.base.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return s.conn.CheckNamedValue(value)
+}
+
+type instrumentedTx struct {
+	base driver.Tx
+	// Context of the BEGIN, for the labels of the COMMIT or the ROLLBACK
+	ctx context.Context
+	sql *sqlReporter
+}
+
+func (t *instrumentedTx) Commit() error {
+	start := time.Now()
+	err := t.base.Commit()
+	t.sql.report(t.ctx, SQL_COMMIT, "", start, err)
+	return err
+}
+
+func (t *instrumentedTx) Rollback() error {
+	start := time.Now()
+	err := t.base.Rollback()
+	t.sql.report(t.ctx, SQL_ROLLBACK, "", start, err)
+	return err
+}
+
+// The arguments of the drivers that predate driver.NamedValue, which cannot take named ones
+func namedValuesToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("sql: driver does not support the use of Named Parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
@@ -0,0 +1,394 @@
+package monitor_tool
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type sqlTestReport struct {
+	name   string
+	labels map[string]string
+	code   int
+}
+
+// A ReportClient that records what the database/sql wrappers report
+type sqlRecordingClient struct {
+	ReportClient
+	lock    sync.Mutex
+	reports []sqlTestReport
+}
+
+func (c *sqlRecordingClient) ReportDuration(name string, d time.Duration, code int) error {
+	return c.ReportDurationWithLabels(name, nil, d, code)
+}
+
+func (c *sqlRecordingClient) ReportDurationWithLabels(name string, labels map[string]string, d time.Duration, code int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.reports = append(c.reports, sqlTestReport{name: name, labels: labels, code: code})
+	return nil
+}
+
+// Reports since the previous call
+func (c *sqlRecordingClient) take() []sqlTestReport {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	reports := c.reports
+	c.reports = nil
+	return reports
+}
+
+func expectReports(t *testing.T, client *sqlRecordingClient, want ...sqlTestReport) {
+	t.Helper()
+	got := client.take()
+	if len(got) != len(want) {
+		t.Fatalf("reported %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].name != want[i].name || got[i].code != want[i].code || fmt.Sprint(got[i].labels) != fmt.Sprint(want[i].labels) {
+			t.Fatalf("reported %v, want %v", got, want)
+		}
+	}
+}
+
+// An in-memory driver: a query containing "badconn" fails with driver.ErrBadConn, the others succeed and
+// return a single row. Without withContext, the connections only implement the original driver.Conn
+type fakeSQLDriver struct {
+	withContext bool
+	// Statements convert their arguments with a driver.ColumnConverter
+	withConverter bool
+	lock          sync.Mutex
+	args          [][]driver.Value
+}
+
+func (d *fakeSQLDriver) Open(string) (driver.Conn, error) {
+	conn := &fakeSQLConn{driver: d}
+	if d.withContext {
+		return &fakeSQLContextConn{conn}, nil
+	}
+	return conn, nil
+}
+
+func (d *fakeSQLDriver) run(query string, args []driver.Value) error {
+	d.lock.Lock()
+	d.args = append(d.args, args)
+	d.lock.Unlock()
+	if strings.Contains(query, "badconn") {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+type fakeSQLConnector struct {
+	driver *fakeSQLDriver
+}
+
+func (c fakeSQLConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open("")
+}
+
+func (c fakeSQLConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type fakeSQLConn struct {
+	driver *fakeSQLDriver
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	if strings.Contains(query, "badconn") {
+		return nil, driver.ErrBadConn
+	}
+	stmt := &fakeSQLStmt{conn: c, query: query}
+	if c.driver.withConverter {
+		return fakeSQLConverterStmt{stmt}, nil
+	}
+	return stmt, nil
+}
+
+func (c *fakeSQLConn) Close() error {
+	return nil
+}
+
+func (c *fakeSQLConn) Begin() (driver.Tx, error) {
+	return fakeSQLTx{}, nil
+}
+
+type fakeSQLContextConn struct {
+	*fakeSQLConn
+}
+
+func (c *fakeSQLContextConn) PrepareContext(_ context.Context, query string) (driver.Stmt, error) {
+	return c.Prepare(query)
+}
+
+func (c *fakeSQLContextConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return fakeSQLTx{}, nil
+}
+
+func (c *fakeSQLContextConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	values, _ := namedValuesToValues(args)
+	if err := c.driver.run(query, values); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeSQLContextConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	values, _ := namedValuesToValues(args)
+	if err := c.driver.run(query, values); err != nil {
+		return nil, err
+	}
+	return &fakeSQLRows{}, nil
+}
+
+type fakeSQLStmt struct {
+	conn  *fakeSQLConn
+	query string
+}
+
+func (s *fakeSQLStmt) Close() error {
+	return nil
+}
+
+func (s *fakeSQLStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if err := s.conn.driver.run(s.query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := s.conn.driver.run(s.query, args); err != nil {
+		return nil, err
+	}
+	return &fakeSQLRows{}, nil
+}
+
+// Arguments are turned into strings prefixed with their column
+type fakeSQLConverterStmt struct {
+	*fakeSQLStmt
+}
+
+func (s fakeSQLConverterStmt) ColumnConverter(idx int) driver.ValueConverter {
+	return fakeSQLConverter(idx)
+}
+
+type fakeSQLConverter int
+
+func (c fakeSQLConverter) ConvertValue(v any) (driver.Value, error) {
+	return fmt.Sprintf("%d:%v", int(c), v), nil
+}
+
+type fakeSQLTx struct{}
+
+func (fakeSQLTx) Commit() error {
+	return nil
+}
+
+func (fakeSQLTx) Rollback() error {
+	return nil
+}
+
+type fakeSQLRows struct {
+	done bool
+}
+
+func (r *fakeSQLRows) Columns() []string {
+	return []string{"id"}
+}
+
+func (r *fakeSQLRows) Close() error {
+	return nil
+}
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = int64(1)
+	return nil
+}
+
+var sqlDriverCount int
+
+// Register the wrapped driver under a name of its own and open it
+func openSQLDriver(t *testing.T, client ReportClient, base driver.Driver, config SQLConfig) *sql.DB {
+	t.Helper()
+	sqlDriverCount++
+	name := fmt.Sprintf("monitor-test-%d", sqlDriverCount)
+	sql.Register(name, NewSQLDriver(client, base, config))
+	db, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSQLDriverWithoutContext(t *testing.T) {
+	client := &sqlRecordingClient{}
+	db := openSQLDriver(t, client, &fakeSQLDriver{}, SQLConfig{})
+	db.SetMaxIdleConns(1)
+	// Without Execer and Queryer, database/sql prepares every statement
+	if _, err := db.Exec("INSERT INTO users (id, name) VALUES (1, 'bob')"); err != nil {
+		t.Fatal(err)
+	}
+	expectReports(t, client,
+		sqlTestReport{name: "PREPARE INSERT INTO users (id, name) VALUES (?)", code: 200},
+		sqlTestReport{name: "EXEC INSERT INTO users (id, name) VALUES (?)", code: 200},
+	)
+	var id int
+	if err := db.QueryRow("SELECT id FROM users WHERE id = $1", 1).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	expectReports(t, client,
+		sqlTestReport{name: "PREPARE SELECT id FROM users WHERE id = ?", code: 200},
+		sqlTestReport{name: "QUERY SELECT id FROM users WHERE id = ?", code: 200},
+	)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	expectReports(t, client,
+		sqlTestReport{name: SQL_BEGIN, code: 200},
+		sqlTestReport{name: SQL_COMMIT, code: 200},
+		sqlTestReport{name: SQL_BEGIN, code: 200},
+		sqlTestReport{name: SQL_ROLLBACK, code: 200},
+	)
+	// database/sql retries a bad connection, every attempt is reported
+	if _, err := db.Exec("DELETE FROM badconn"); !errors.Is(err, driver.ErrBadConn) {
+		t.Fatalf("Exec returned %v, want driver.ErrBadConn", err)
+	}
+	reports := client.take()
+	if len(reports) == 0 {
+		t.Fatal("the failed statement was not reported")
+	}
+	for _, r := range reports {
+		if r.name != "PREPARE DELETE FROM badconn" || r.code != CODE_BAD_CONN {
+			t.Fatalf("reported %v, want PREPARE DELETE FROM badconn with CODE_BAD_CONN", reports)
+		}
+	}
+}
+
+func TestSQLConnectorWithContext(t *testing.T) {
+	client := &sqlRecordingClient{}
+	type tenantKey struct{}
+	db := sql.OpenDB(NewSQLConnector(client, fakeSQLConnector{&fakeSQLDriver{withContext: true}}, SQLConfig{
+		Labels: func(ctx context.Context) map[string]string {
+			if tenant, ok := ctx.Value(tenantKey{}).(string); ok {
+				return map[string]string{"tenant": tenant}
+			}
+			return nil
+		},
+	}))
+	defer db.Close()
+	ctx := context.WithValue(context.Background(), tenantKey{}, "acme")
+	labels := map[string]string{"tenant": "acme"}
+	// The connection executes the statements itself, nothing is prepared
+	if _, err := db.ExecContext(ctx, "UPDATE users SET name = 'bob' WHERE id IN (1, 2, 3)"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.QueryContext(ctx, "SELECT id FROM users WHERE id = ?", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	expectReports(t, client,
+		sqlTestReport{name: "EXEC UPDATE users SET name = ? WHERE id IN (?)", labels: labels, code: 200},
+		sqlTestReport{name: "QUERY SELECT id FROM users WHERE id = ?", labels: labels, code: 200},
+	)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.ExecContext(context.Background(), "DELETE FROM users"); err != nil {
+		t.Fatal(err)
+	}
+	// COMMIT takes the labels of the BEGIN
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	expectReports(t, client,
+		sqlTestReport{name: SQL_BEGIN, labels: labels, code: 200},
+		sqlTestReport{name: "EXEC DELETE FROM users", code: 200},
+		sqlTestReport{name: SQL_COMMIT, labels: labels, code: 200},
+	)
+	if _, err := db.QueryContext(ctx, "SELECT * FROM badconn"); !errors.Is(err, driver.ErrBadConn) {
+		t.Fatalf("Query returned %v, want driver.ErrBadConn", err)
+	}
+	for _, r := range client.take() {
+		if r.name != "QUERY SELECT * FROM badconn" || r.code != CODE_BAD_CONN {
+			t.Fatalf("reported %v for a bad connection", r)
+		}
+	}
+}
+
+func TestSQLColumnConverter(t *testing.T) {
+	client := &sqlRecordingClient{}
+	base := &fakeSQLDriver{withConverter: true}
+	db := openSQLDriver(t, client, base, SQLConfig{
+		Name: func(operation string, query string) string { return operation },
+	})
+	stmt, err := db.Prepare("INSERT INTO users VALUES (?, ?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	if _, err := stmt.Exec(7, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	expectReports(t, client,
+		sqlTestReport{name: SQL_PREPARE, code: 200},
+		sqlTestReport{name: SQL_EXEC, code: 200},
+	)
+	base.lock.Lock()
+	defer base.lock.Unlock()
+	if got := fmt.Sprint(base.args); got != "[[0:7 1:bob]]" {
+		t.Fatalf("the statement received %s, the column converter of the driver was not used", got)
+	}
+}
+
+func TestSQLFingerprint(t *testing.T) {
+	for _, c := range []struct {
+		query string
+		want  string
+	}{
+		{"SELECT * FROM users WHERE id = 42", "SELECT * FROM users WHERE id = ?"},
+		{"SELECT * FROM users WHERE name = 'O''Brien' AND score > -1.5e3", "SELECT * FROM users WHERE name = ? AND score > -?"},
+		{"SELECT * FROM users WHERE id IN (1, 2, 3)", "SELECT * FROM users WHERE id IN (?)"},
+		{"SELECT * FROM users WHERE id IN ($1,$2, $3)", "SELECT * FROM users WHERE id IN (?)"},
+		{"INSERT INTO users (id, name) VALUES (1, 'a'), (2, 'b'),\n\t(3, 'c')", "INSERT INTO users (id, name) VALUES (?)"},
+		{"SELECT id -- the key\nFROM /* all the */ users", "SELECT id FROM users"},
+		{"UPDATE users SET name = $2 WHERE id = $1", "UPDATE users SET name = ? WHERE id = ?"},
+		{`SELECT "col1", ` + "`t2`.x FROM t2 WHERE b = X'ff' AND n = N'abc'", `SELECT "col1", ` + "`t2`.x FROM t2 WHERE b = ? AND n = ?"},
+		{"SELECT\tid\n\nFROM   users", "SELECT id FROM users"},
+	} {
+		if got := SQLFingerprint(c.query); got != c.want {
+			t.Errorf("SQLFingerprint(%q) = %q, want %q", c.query, got, c.want)
+		}
+	}
+}
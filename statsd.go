@@ -0,0 +1,186 @@
+package monitor_tool
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StatsDConfig Configuration of a StatsD exporter
+type StatsDConfig struct {
+	// Address of the agent, the default is 127.0.0.1:8125
+	Address string
+	// Prepended to every metric name, e.g. "myapp."
+	Prefix string
+	// Send DogStatsD tags for the client, the interface, the labels and the failure codes.
+	// Without tags they are encoded into the metric name instead
+	DogStatsD bool
+	// Constant tags added to every metric in DogStatsD mode, e.g. "env:prod"
+	Tags []string
+	// Maximum payload of one UDP packet, the default 1432 fits an ethernet MTU
+	MaxPacketSize int
+	// Number of outputs waiting to be sent, the default is 1024. When the queue is full, outputs are dropped
+	QueueSize int
+}
+
+// StatsDExporter Sends every OutPutData to a StatsD agent over UDP as counters, gauges and timers.
+// Its Output is meant as the OutputCaller of a client: a goroutine of the exporter packs the lines of the
+// queued outputs into packets of at most MaxPacketSize bytes. UDP is fire and forget, an output is only
+// lost when the queue is full or the exporter closed
+type StatsDExporter struct {
+	outputQueue
+	config StatsDConfig
+	conn   net.Conn
+	packet bytes.Buffer
+	line   bytes.Buffer
+}
+
+func NewStatsDExporter(config StatsDConfig) (*StatsDExporter, error) {
+	if config.Address == "" {
+		config.Address = "127.0.0.1:8125"
+	}
+	if config.MaxPacketSize <= 0 {
+		config.MaxPacketSize = 1432
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1024
+	}
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	e := &StatsDExporter{
+		config: config,
+		conn:   conn,
+	}
+	e.outputQueue.init(config.QueueSize)
+	go e.send()
+	return e, nil
+}
+
+// Close Send what is queued and release the socket
+func (e *StatsDExporter) Close() error {
+	if !e.outputQueue.close() {
+		return errors.New("the statsd exporter has been closed")
+	}
+	<-e.done
+	return e.conn.Close()
+}
+
+func (e *StatsDExporter) send() {
+	defer close(e.done)
+	for o := range e.queue {
+		e.writeOutput(&o)
+		// Nothing else is waiting, do not hold a partial packet back
+		if len(e.queue) == 0 {
+			e.flush()
+		}
+	}
+	e.flush()
+}
+
+func (e *StatsDExporter) flush() {
+	if e.packet.Len() == 0 {
+		return
+	}
+	// UDP is fire and forget, an absent agent is not an error worth reporting
+	e.conn.Write(e.packet.Bytes())
+	e.packet.Reset()
+}
+
+func (e *StatsDExporter) writeOutput(o *OutPutData) {
+	var path string
+	var tags []string
+	if e.config.DogStatsD {
+		tags = append(tags, e.config.Tags...)
+		tags = append(tags, "client:"+statsDTagValue(o.ClientName), "interface:"+statsDTagValue(o.InterfaceName))
+		for _, k := range sortedLabelKeys(o.Labels) {
+			tags = append(tags, metricNamePart(k)+":"+statsDTagValue(o.Labels[k]))
+		}
+	} else {
+		path = metricNamePart(o.ClientName) + "." + metricNamePart(o.InterfaceName) + "."
+		for _, k := range sortedLabelKeys(o.Labels) {
+			path += metricNamePart(k) + "_" + metricNamePart(o.Labels[k]) + "."
+		}
+	}
+	e.writeLine(path+"count", strconv.FormatUint(uint64(o.Count), 10), "c", tags)
+	e.writeLine(path+"success", strconv.FormatUint(uint64(o.SuccessCount), 10), "c", tags)
+	e.writeLine(path+"fail", strconv.FormatUint(uint64(o.FailCount), 10), "c", tags)
+	e.writeLine(path+"fast", strconv.FormatUint(uint64(o.FastCount), 10), "c", tags)
+	e.writeLine(path+"success_rate", strconv.FormatFloat(o.SuccessRate, 'f', -1, 64), "g", tags)
+	e.writeLine(path+"fast_rate", strconv.FormatFloat(o.FastRate, 'f', -1, 64), "g", tags)
+	if o.SuccessCount > 0 {
+		e.writeLine(path+"latency.avg", strconv.FormatUint(uint64(o.SuccessMsAver), 10), "ms", tags)
+		e.writeLine(path+"latency.max", strconv.FormatUint(uint64(o.MaxMs), 10), "ms", tags)
+		e.writeLine(path+"latency.min", strconv.FormatUint(uint64(o.MinMs), 10), "ms", tags)
+		for _, name := range sortedKeys(o.Percentiles) {
+			e.writeLine(path+"latency."+metricNamePart(name), strconv.FormatUint(uint64(o.Percentiles[name]), 10), "g", tags)
+		}
+	}
+	for _, name := range sortedKeys(o.FailDistribution) {
+		count := strconv.FormatUint(uint64(o.FailDistribution[name]), 10)
+		if e.config.DogStatsD {
+			e.writeLine("fail_by_code", count, "c", append(tags[:len(tags):len(tags)], "code:"+statsDTagValue(name)))
+		} else {
+			e.writeLine(path+"fail_by_code."+metricNamePart(name), count, "c", nil)
+		}
+	}
+}
+
+// Append one line to the packet, the packet is sent first when the line would not fit in
+func (e *StatsDExporter) writeLine(name string, value string, metricType string, tags []string) {
+	e.line.Reset()
+	e.line.WriteString(e.config.Prefix + name + ":" + value + "|" + metricType)
+	if len(tags) > 0 {
+		e.line.WriteString("|#" + strings.Join(tags, ","))
+	}
+	if e.packet.Len() > 0 && e.packet.Len()+1+e.line.Len() > e.config.MaxPacketSize {
+		e.flush()
+	}
+	if e.packet.Len() > 0 {
+		e.packet.WriteByte('\n')
+	}
+	e.packet.Write(e.line.Bytes())
+}
+
+// Metric name parts (StatsD, Graphite) are limited to [a-zA-Z0-9_-], dots separate the parts
+func metricNamePart(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r == '-' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// Tag values must not contain the separators of the DogStatsD datagram
+func statsDTagValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ',', '|', '#', '\n', '\r', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func sortedLabelKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedKeys(m map[string]uint32) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
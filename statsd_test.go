@@ -0,0 +1,153 @@
+package monitor_tool
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Send the outputs to an exporter on a local UDP listener, close it and return the packets it sent
+func statsDPackets(t *testing.T, config StatsDConfig, outputs ...*OutPutData) []string {
+	t.Helper()
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	config.Address = listener.LocalAddr().String()
+	e, err := NewStatsDExporter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range outputs {
+		e.Output(o)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var packets []string
+	buffer := make([]byte, 65536)
+	for {
+		listener.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := listener.ReadFrom(buffer)
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, string(buffer[:n]))
+	}
+}
+
+func statsDOutput() *OutPutData {
+	return &OutPutData{
+		ClientName:       "api",
+		InterfaceName:    "GET /users",
+		Labels:           map[string]string{"zone": "eu 1|a"},
+		Count:            4,
+		SuccessCount:     3,
+		FailCount:        1,
+		FastCount:        2,
+		SuccessRate:      0.75,
+		FastRate:         0.5,
+		SuccessMsAver:    12,
+		MaxMs:            20,
+		MinMs:            4,
+		Percentiles:      map[string]uint32{"p99": 20},
+		FailDistribution: map[string]uint32{"500": 1},
+	}
+}
+
+func TestStatsDLines(t *testing.T) {
+	packets := statsDPackets(t, StatsDConfig{Prefix: "app."}, statsDOutput())
+	if len(packets) != 1 {
+		t.Fatalf("%d packets, want 1", len(packets))
+	}
+	want := []string{
+		"app.api.GET__users.zone_eu_1_a.count:4|c",
+		"app.api.GET__users.zone_eu_1_a.success:3|c",
+		"app.api.GET__users.zone_eu_1_a.fail:1|c",
+		"app.api.GET__users.zone_eu_1_a.fast:2|c",
+		"app.api.GET__users.zone_eu_1_a.success_rate:0.75|g",
+		"app.api.GET__users.zone_eu_1_a.fast_rate:0.5|g",
+		"app.api.GET__users.zone_eu_1_a.latency.avg:12|ms",
+		"app.api.GET__users.zone_eu_1_a.latency.max:20|ms",
+		"app.api.GET__users.zone_eu_1_a.latency.min:4|ms",
+		"app.api.GET__users.zone_eu_1_a.latency.p99:20|g",
+		"app.api.GET__users.zone_eu_1_a.fail_by_code.500:1|c",
+	}
+	if got := strings.Split(packets[0], "\n"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("lines\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestDogStatsDTags(t *testing.T) {
+	packets := statsDPackets(t, StatsDConfig{DogStatsD: true, Tags: []string{"env:prod"}}, statsDOutput())
+	if len(packets) != 1 {
+		t.Fatalf("%d packets, want 1", len(packets))
+	}
+	tags := "|#env:prod,client:api,interface:GET_/users,zone:eu_1_a"
+	want := []string{
+		"count:4|c" + tags,
+		"success:3|c" + tags,
+		"fail:1|c" + tags,
+		"fast:2|c" + tags,
+		"success_rate:0.75|g" + tags,
+		"fast_rate:0.5|g" + tags,
+		"latency.avg:12|ms" + tags,
+		"latency.max:20|ms" + tags,
+		"latency.min:4|ms" + tags,
+		"latency.p99:20|g" + tags,
+		"fail_by_code:1|c" + tags + ",code:500",
+	}
+	if got := strings.Split(packets[0], "\n"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("lines\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestStatsDPacketsFitTheMaxPacketSize(t *testing.T) {
+	outputs := make([]*OutPutData, 5)
+	for i := range outputs {
+		outputs[i] = statsDOutput()
+	}
+	whole := statsDPackets(t, StatsDConfig{MaxPacketSize: 65000}, outputs...)
+	split := statsDPackets(t, StatsDConfig{MaxPacketSize: 200}, outputs...)
+	if len(split) <= len(whole) {
+		t.Fatalf("%d packets of at most 200 bytes, %d of at most 65000", len(split), len(whole))
+	}
+	for _, packet := range split {
+		if len(packet) > 200 {
+			t.Fatalf("a packet of %d bytes", len(packet))
+		}
+	}
+	// Lines are never cut
+	if got, want := strings.Join(split, "\n"), strings.Join(whole, "\n"); got != want {
+		t.Fatalf("split lines\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestStatsDDropsWhenTheQueueIsFull(t *testing.T) {
+	// Without its sending goroutine, the exporter never empties its queue
+	e := &StatsDExporter{config: StatsDConfig{QueueSize: 2}}
+	e.outputQueue.init(2)
+	for i := 0; i < 5; i++ {
+		e.Output(statsDOutput())
+	}
+	if e.Dropped() != 3 {
+		t.Fatalf("%d outputs dropped, want 3", e.Dropped())
+	}
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	closed, err := NewStatsDExporter(StatsDConfig{Address: listener.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	closed.Output(statsDOutput())
+	if closed.Dropped() != 1 {
+		t.Fatalf("%d outputs dropped after Close, want 1", closed.Dropped())
+	}
+}
@@ -0,0 +1,67 @@
+package monitor_tool
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// DefaultErrorClassifier The default ReportClientConfig.ErrorClassifier: no error is 200, context.Canceled
+// is CODE_CANCELED, context.DeadlineExceeded and network timeouts are CODE_TIMEOUT, any other error is CODE_ERROR
+func DefaultErrorClassifier(err error) int {
+	if err == nil {
+		return 200
+	}
+	if errors.Is(err, context.Canceled) {
+		return CODE_CANCELED
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return CODE_TIMEOUT
+	}
+	return CODE_ERROR
+}
+
+// Track Start timing an operation, the returned function reports it with its code when it is done:
+//
+//	done := client.Track("cache.get")
+//	...
+//	done(200)
+//
+// The elapsed time is measured on the monotonic clock
+func (c *ReportClientConfig) Track(name string) func(code int) {
+	start := time.Now()
+	return func(code int) {
+		c.ReportDuration(name, time.Since(start), code)
+	}
+}
+
+// Observe Run the operation and report it, with the code ErrorClassifier gives to the error it returns.
+// The error is returned unchanged
+func (c *ReportClientConfig) Observe(name string, operation func() error) error {
+	start := time.Now()
+	err := operation()
+	c.ReportDuration(name, time.Since(start), c.classify(err))
+	return err
+}
+
+// Observe Same as ReportClient.Observe, for an operation that returns a value as well:
+//
+//	user, err := Observe(client, "db.user", func() (*User, error) { return loadUser(ctx, id) })
+func Observe[T any](client ReportClient, name string, operation func() (T, error)) (T, error) {
+	var result T
+	err := client.Observe(name, func() error {
+		var err error
+		result, err = operation()
+		return err
+	})
+	return result, err
+}
+
+func (c *ReportClientConfig) classify(err error) int {
+	if c.ErrorClassifier != nil {
+		return c.ErrorClassifier(err)
+	}
+	return DefaultErrorClassifier(err)
+}
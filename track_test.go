@@ -0,0 +1,91 @@
+package monitor_tool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTrack(t *testing.T) {
+	client, outputs := collectingClient(t, ReportClientConfig{Name: "track", StatisticalCycle: 60000})
+	done := client.Track("cache.get")
+	time.Sleep(20 * time.Millisecond)
+	done(200)
+	client.Track("cache.get")(CODE_TIMEOUT)
+	if err := client.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := outputs()
+	if len(got) != 1 {
+		t.Fatalf("%d outputs, want 1", len(got))
+	}
+	o := got[0]
+	if o.InterfaceName != "cache.get" || o.SuccessCount != 1 || o.MinUs < 20000 || !reflect.DeepEqual(o.FailDistribution, map[string]uint32{"timeout": 1}) {
+		t.Fatalf("output %+v, want a success of at least 20ms and a timeout", o)
+	}
+}
+
+func TestDefaultErrorClassifier(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{nil, 200},
+		{errors.New("failed"), CODE_ERROR},
+		{fmt.Errorf("query: %w", context.Canceled), CODE_CANCELED},
+		{fmt.Errorf("query: %w", context.DeadlineExceeded), CODE_TIMEOUT},
+		{&net.OpError{Op: "read", Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}, CODE_TIMEOUT},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, CODE_ERROR},
+	} {
+		if code := DefaultErrorClassifier(c.err); code != c.code {
+			t.Errorf("the error %v has the code %d, want %d", c.err, code, c.code)
+		}
+	}
+}
+
+func TestObserve(t *testing.T) {
+	notFound := errors.New("not found")
+	client, outputs := collectingClient(t, ReportClientConfig{
+		Name:             "observe",
+		StatisticalCycle: 60000,
+		ErrorClassifier: func(err error) int {
+			if errors.Is(err, notFound) {
+				return 404
+			}
+			return DefaultErrorClassifier(err)
+		},
+	})
+	failed := errors.New("failed")
+	for _, err := range []error{nil, failed, notFound, context.Canceled} {
+		if got := client.Observe("db.query", func() error { return err }); got != err {
+			t.Fatalf("Observe returned %v, want %v", got, err)
+		}
+	}
+	user, err := Observe(client, "db.user", func() (string, error) { return "ada", nil })
+	if user != "ada" || err != nil {
+		t.Fatalf("Observe returned %q and %v", user, err)
+	}
+	if _, err := Observe(client, "db.user", func() (string, error) { return "", failed }); err != failed {
+		t.Fatalf("Observe returned %v, want %v", err, failed)
+	}
+	if err := client.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	failures := map[string]map[string]uint32{}
+	successes := map[string]uint32{}
+	for _, o := range outputs() {
+		failures[o.InterfaceName] = o.FailDistribution
+		successes[o.InterfaceName] = o.SuccessCount
+	}
+	want := map[string]map[string]uint32{
+		"db.query": {"error": 1, "code[404]": 1, "canceled": 1},
+		"db.user":  {"error": 1},
+	}
+	if !reflect.DeepEqual(failures, want) || successes["db.query"] != 1 || successes["db.user"] != 1 {
+		t.Fatalf("failures %v and successes %v, want %v and one success each", failures, successes, want)
+	}
+}
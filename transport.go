@@ -0,0 +1,85 @@
+package monitor_tool
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// TransportConfig Configuration of NewTransport
+type TransportConfig struct {
+	// The wrapped transport, the default is http.DefaultTransport
+	Base http.RoundTripper
+	// Name of the entry of a request, the default is the method, the host and the path normalized by
+	// PathNormalizer, e.g. "GET api.example.com/users/{id}"
+	Name func(r *http.Request) string
+	// Labels of the report of a request, nil reports without labels
+	Labels func(r *http.Request) map[string]string
+}
+
+// NewTransport Wraps an http.RoundTripper to report every outbound call to the client, with the status
+// code of the response or one of the CODE_* codes when there is none, and the time until the response
+// headers were received (reading the body is not included).
+// Use HTTPCodeFeature as GetCodeFeature of the client to count 2xx and 3xx as successes
+func NewTransport(client ReportClient, config TransportConfig) http.RoundTripper {
+	if config.Base == nil {
+		config.Base = http.DefaultTransport
+	}
+	if config.Name == nil {
+		normalizer := NewPathNormalizer()
+		config.Name = func(r *http.Request) string {
+			return r.Method + " " + r.URL.Host + normalizer.Normalize(r.URL.Path)
+		}
+	}
+	return &instrumentedTransport{client: client, config: config}
+}
+
+type instrumentedTransport struct {
+	client ReportClient
+	config TransportConfig
+}
+
+func (t *instrumentedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	response, err := t.config.Base.RoundTrip(r)
+	elapsed := time.Since(start)
+	code := TransportErrorCode(err)
+	if err == nil {
+		code = response.StatusCode
+	}
+	name := t.config.Name(r)
+	if t.config.Labels != nil {
+		t.client.ReportDurationWithLabels(name, t.config.Labels(r), elapsed, code)
+	} else {
+		t.client.ReportDuration(name, elapsed, code)
+	}
+	return response, err
+}
+
+// TransportErrorCode The CODE_* code of an error returned by an http.RoundTripper or an http.Client,
+// 0 for a nil error
+func TransportErrorCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if errors.Is(err, context.Canceled) {
+		return CODE_CANCELED
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return CODE_DNS
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return CODE_TIMEOUT
+	}
+	var recordErr tls.RecordHeaderError
+	var verificationErr *tls.CertificateVerificationError
+	if errors.As(err, &recordErr) || errors.As(err, &verificationErr) {
+		return CODE_TLS
+	}
+	return CODE_NETWORK
+}
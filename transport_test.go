@@ -0,0 +1,104 @@
+package monitor_tool
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransportCodes(t *testing.T) {
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/slow") {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+		w.WriteHeader(503)
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	tlsServer := httptest.NewUnstartedServer(handler)
+	// The handshakes rejected by the client are not worth a log line
+	tlsServer.Config.ErrorLog = log.New(io.Discard, "", 0)
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	defer close(release)
+	// A port nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := "http://" + listener.Addr().String()
+	listener.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	for _, c := range []struct {
+		name   string
+		url    string
+		ctx    func() (context.Context, context.CancelFunc)
+		code   int
+		report string
+	}{
+		{"response", server.URL + "/users/42", nil, 503, "GET " + host + "/users/{id}"},
+		{"refused", refused + "/", nil, CODE_NETWORK, "GET " + strings.TrimPrefix(refused, "http://") + "/"},
+		{"dns", "http://monitor-tool.invalid/", nil, CODE_DNS, "GET monitor-tool.invalid/"},
+		{"untrusted certificate", tlsServer.URL + "/", nil, CODE_TLS, "GET " + strings.TrimPrefix(tlsServer.URL, "https://") + "/"},
+		{"timeout", server.URL + "/slow", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 50*time.Millisecond)
+		}, CODE_TIMEOUT, "GET " + host + "/slow"},
+		{"canceled", server.URL + "/slow", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			return ctx, cancel
+		}, CODE_CANCELED, "GET " + host + "/slow"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			client := &sqlRecordingClient{}
+			httpClient := &http.Client{Transport: NewTransport(client, TransportConfig{})}
+			ctx, cancel := context.Background(), context.CancelFunc(func() {})
+			if c.ctx != nil {
+				ctx, cancel = c.ctx()
+			}
+			defer cancel()
+			request, err := http.NewRequestWithContext(ctx, "GET", c.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := httpClient.Do(request)
+			if err == nil {
+				response.Body.Close()
+			}
+			if code := TransportErrorCode(err); (c.code > 0 && code != 0) || (c.code < 0 && code != c.code) {
+				t.Fatalf("the error %v of the client has the code %d, want %d", err, code, c.code)
+			}
+			expectReports(t, client, sqlTestReport{name: c.report, code: c.code})
+		})
+	}
+}
+
+func TestTransportErrorCodeOfWrappedErrors(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{nil, 0},
+		{errors.New("reset"), CODE_NETWORK},
+		{&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}, CODE_DNS},
+		{&net.DNSError{Err: "i/o timeout", IsTimeout: true}, CODE_DNS},
+		{&net.OpError{Op: "read", Err: context.DeadlineExceeded}, CODE_TIMEOUT},
+		{errors.Join(errors.New("request"), context.Canceled), CODE_CANCELED},
+	} {
+		if code := TransportErrorCode(c.err); code != c.code {
+			t.Errorf("the error %v has the code %d, want %d", c.err, code, c.code)
+		}
+	}
+}
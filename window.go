@@ -0,0 +1,109 @@
+package monitor_tool
+
+import (
+	"sort"
+	"time"
+)
+
+// ReportAt Same as Report for an event that happened at ts, such as buffered mobile or queue telemetry:
+// it is counted in the window of its own time, windows being aligned on StatisticalCycle (a 60s cycle
+// gives the windows of every minute), instead of the cycle open when the collector handles it.
+// A window is output once the clock has passed its end by ReportClientConfig.AllowedLateness, with its
+// end as Timestamp. Events of a window already output return ErrReportLate and are counted in Late,
+// events from the future are counted in the current window and a zero ts is the time of the call.
+// Use either Report or ReportAt for a name: the alarms of an entry expect its outputs in order
+func (c *ReportClientConfig) ReportAt(name string, ts time.Time, ms uint32, code int) error {
+	if c.counters == nil {
+		return ErrNotRegistered
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	// The collector drops the late events anyway, sparing them the task channel is all this is for
+	if !c.windowStart(ts).Add(c.cycle()).After(time.Unix(0, c.counters.watermark.Load())) {
+		c.counters.late.Add(1)
+		return ErrReportLate
+	}
+	return c.report(reportServer{
+		Code: code,
+		Us:   uint64(ms) * usPerMs,
+		Name: c.reportName(name),
+		Time: ts,
+	}, c.OverflowPolicy)
+}
+
+// Late Number of ReportAt events dropped for arriving after the allowed lateness since registration
+func (c *ReportClientConfig) Late() uint64 {
+	if c.counters == nil {
+		return 0
+	}
+	return c.counters.late.Load()
+}
+
+func (c *ReportClientConfig) cycle() time.Duration {
+	return time.Duration(c.StatisticalCycle) * time.Millisecond
+}
+
+// Entries kept by the collector, those of the open windows included: MaxEntries applies to all of them
+func (c *ReportClientConfig) entryCount() int {
+	n := len(c.collectDataMap)
+	for _, window := range c.eventWindows {
+		n += len(window)
+	}
+	return n
+}
+
+// Start of the aligned window of an event time
+func (c *ReportClientConfig) windowStart(ts time.Time) time.Time {
+	return ts.Truncate(c.cycle())
+}
+
+// The windows ending at or before the watermark are output, it trails the clock by AllowedLateness
+func (c *ReportClientConfig) setWatermark(now time.Time) {
+	// Event times come from anywhere, they are compared on the wall clock
+	c.watermark = now.Round(0).Add(-c.AllowedLateness)
+	c.counters.watermark.Store(c.watermark.UnixNano())
+}
+
+// The entries of the window of an event time, nil when the window has already been output.
+// Called by the collector
+func (c *ReportClientConfig) eventWindow(ts time.Time) map[string]*reportData {
+	if now := time.Now(); ts.After(now) {
+		ts = now
+	}
+	start := c.windowStart(ts)
+	if !start.Add(c.cycle()).After(c.watermark) {
+		c.counters.late.Add(1)
+		return nil
+	}
+	window := c.eventWindows[start.UnixNano()]
+	if window == nil {
+		window = map[string]*reportData{}
+		c.eventWindows[start.UnixNano()] = window
+	}
+	return window
+}
+
+// Move the watermark to the time of the cycle and output the windows it has passed, oldest first, with
+// the reports dropped during the cycle. The final flush outputs every open window. Called by the collector
+func (c *ReportClientConfig) closeEventWindows(curClearData *clearData, dropped uint64) {
+	c.setWatermark(curClearData.Time)
+	starts := make([]int64, 0, len(c.eventWindows))
+	for start := range c.eventWindows {
+		end := time.Unix(0, start).Add(c.cycle())
+		if curClearData.final || !end.After(c.watermark) {
+			starts = append(starts, start)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	for _, start := range starts {
+		end := time.Unix(0, start).Add(c.cycle())
+		for _, windowData := range c.eventWindows[start] {
+			collectedData := *windowData
+			collectedData.Time = end
+			collectedData.Dropped = dropped
+			c.statisticsChannel <- collectedData
+		}
+		delete(c.eventWindows, start)
+	}
+}
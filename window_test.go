@@ -0,0 +1,37 @@
+package monitor_tool
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMaxEntriesCountsEventWindows(t *testing.T) {
+	client, outputs := collectingClient(t, ReportClientConfig{
+		Name:             "windows",
+		StatisticalCycle: 60000,
+		AllowedLateness:  time.Hour,
+		MaxEntries:       2,
+	})
+	past := time.Now().Add(-2 * time.Minute)
+	if err := client.Report("a", 10, 200); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b", "c"} {
+		if err := client.ReportAt(name, past, 10, 200); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, o := range outputs() {
+		names = append(names, o.InterfaceName)
+	}
+	sort.Strings(names)
+	if len(names) != 3 || names[0] != "a" || names[1] != "b" || names[2] != "other" {
+		t.Fatalf("output entries %v, want a, b and other", names)
+	}
+}